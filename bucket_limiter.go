@@ -4,16 +4,26 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// compile-time check that BucketLimiter implements Limiter, ShareLimiter and Restorer interfaces.
+var _ Limiter = &BucketLimiter{}
+var _ ShareLimiter = &BucketLimiter{}
+var _ Restorer = &BucketLimiter{}
+
+// BucketLimiter counts events in fixed windows (buckets) chosen by event timestamp.
+//
+// Bucket counters are updated atomically under read lock, write lock is taken only to shift
+// buckets forward, so concurrent events don't contend for the lock.
 type BucketLimiter struct {
-	mu             sync.Mutex
-	bucketInterval int64 // bucket interval in seconds (60 = 1 min)
-	limit          int64 // maximum number of events per bucket
-	minBucketID    int64 // minimum bucket id
-	buckets        []int64
-	lastUpdate     time.Time
+	mu             sync.RWMutex // write lock guards minBucketID and buckets slice.
+	bucketInterval int64        // bucket interval in seconds (60 = 1 min)
+	limit          int64        // maximum number of events per bucket, accessed atomically.
+	minBucketID    int64        // minimum bucket id
+	buckets        []int64      // counters, accessed atomically.
+	lastUpdate     int64        // the latest event time in unix nanoseconds, accessed atomically.
 }
 
 func NewBucketLimiter(bucketInterval, limit, buckets int64, now time.Time) *BucketLimiter {
@@ -25,77 +35,227 @@ func NewBucketLimiter(bucketInterval, limit, buckets int64, now time.Time) *Buck
 	}
 }
 
-// Allow returns TRUE if event is allowed to be processed.
-func (bl *BucketLimiter) Allow(t time.Time) bool {
-	index := timeToBucketID(t, bl.bucketInterval)
+// Allow returns TRUE if event with time t and specified cost is allowed to be processed.
+// Events with zero cost are always allowed while their bucket is tracked.
+func (bl *BucketLimiter) Allow(t time.Time, cost int64) bool {
+	return bl.AllowShare(t, cost, 1)
+}
 
-	bl.mu.Lock()
-	defer bl.mu.Unlock()
-	bl.lastUpdate = time.Now()
+// AllowShare returns TRUE if event fits into share part of bucket limit.
+func (bl *BucketLimiter) AllowShare(t time.Time, cost int64, share float64) bool {
+	index := timeToBucketID(t, bl.bucketInterval)
+	bl.touch(t)
 
-	max := bl.minBucketID + int64(len(bl.buckets)) - 1
+	bl.mu.RLock()
+	if index > bl.maxBucketID() {
+		bl.mu.RUnlock()
+		bl.shift(index)
+		bl.mu.RLock()
+	}
+	defer bl.mu.RUnlock()
 
 	if index < bl.minBucketID {
 		// limiter doesn't track that bucket anymore.
 		return false
 	}
 
-	if index > max {
-		// event from new bucket. We need to add N new buckets
-		n := index - max
-		for i := 0; int64(i) < n; i++ {
-			bl.buckets = append(bl.buckets, 0)
-		}
+	return bl.increment(index, cost, shareOf(atomic.LoadInt64(&bl.limit), share))
+}
 
-		// remove old ones
-		bl.buckets = bl.buckets[n:]
+// shift moves buckets forward, so bucket index becomes the last tracked one.
+func (bl *BucketLimiter) shift(index int64) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	// buckets could be shifted by another goroutine while lock was released.
+	n := index - bl.maxBucketID()
+	if n <= 0 {
+		return
+	}
 
-		// and set new min index
-		bl.minBucketID += n
+	// event from new bucket. We need to add N new buckets
+	for i := 0; int64(i) < n; i++ {
+		bl.buckets = append(bl.buckets, 0)
 	}
 
-	return bl.increment(index)
+	// remove old ones
+	bl.buckets = bl.buckets[n:]
+
+	// and set new min index
+	bl.minBucketID += n
 }
 
-// LastUpdate returns last Allow method call time.
-func (bl *BucketLimiter) LastUpdate() time.Time {
-	bl.mu.Lock()
-	defer bl.mu.Unlock()
+// maxBucketID returns id of the last tracked bucket.
+// Note: this func is not thread safe, so it must be guarded with lock.
+func (bl *BucketLimiter) maxBucketID() int64 {
+	return bl.minBucketID + int64(len(bl.buckets)) - 1
+}
 
-	return bl.lastUpdate
+// Cancel returns n tokens taken by previous Allow call for the same time.
+// It's used to roll back event that was rejected by another limiter.
+func (bl *BucketLimiter) Cancel(t time.Time, n int64) {
+	index := timeToBucketID(t, bl.bucketInterval)
+
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	i := index - bl.minBucketID
+	if i < 0 || i >= int64(len(bl.buckets)) {
+		// bucket is already shifted out.
+		return
+	}
+
+	for {
+		v := atomic.LoadInt64(&bl.buckets[i])
+		next := v - n
+		if next < 0 {
+			next = 0
+		}
+		if atomic.CompareAndSwapInt64(&bl.buckets[i], v, next) {
+			return
+		}
+	}
+}
+
+// touch updates the latest event time, so late events don't extend limiter life.
+func (bl *BucketLimiter) touch(t time.Time) {
+	n := t.UnixNano()
+	for {
+		last := atomic.LoadInt64(&bl.lastUpdate)
+		if n <= last || atomic.CompareAndSwapInt64(&bl.lastUpdate, last, n) {
+			return
+		}
+	}
+}
+
+// LastUpdate returns time of the latest event passed to Allow.
+func (bl *BucketLimiter) LastUpdate() time.Time {
+	return unixNanoToTime(atomic.LoadInt64(&bl.lastUpdate))
 }
 
 // WriteStatus writes text based status into Writer.
 func (bl *BucketLimiter) WriteStatus(w io.Writer) error {
-	bl.mu.Lock()
-	defer bl.mu.Unlock()
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
 
-	for i, value := range bl.buckets {
+	limit := atomic.LoadInt64(&bl.limit)
+	for i := range bl.buckets {
+		value := atomic.LoadInt64(&bl.buckets[i])
 		fmt.Fprintf(w, "#%s: ", bucketIDToTime(int64(i)+bl.minBucketID, bl.bucketInterval))
-		progress(w, value, bl.limit, 20)
-		fmt.Fprintf(w, " %d/%d\n", value, bl.limit)
+		progress(w, value, limit, 20)
+		fmt.Fprintf(w, " %d/%d\n", value, limit)
 	}
 	return nil
 }
 
+// Utilization returns part of limit used in bucket for time t.
+func (bl *BucketLimiter) Utilization(t time.Time) float64 {
+	index := timeToBucketID(t, bl.bucketInterval)
+
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	i := index - bl.minBucketID
+	if i < 0 || i >= int64(len(bl.buckets)) {
+		return 0
+	}
+
+	return utilization(atomic.LoadInt64(&bl.buckets[i]), atomic.LoadInt64(&bl.limit))
+}
+
+// bucketState is serializable state of BucketLimiter.
+type bucketState struct {
+	MinBucketID int64   `json:"min_bucket_id"`
+	Buckets     []int64 `json:"buckets"`
+}
+
+// Snapshot returns serializable limiter state.
+func (bl *BucketLimiter) Snapshot() Snapshot {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	buckets := make([]int64, len(bl.buckets))
+	for i := range bl.buckets {
+		buckets[i] = atomic.LoadInt64(&bl.buckets[i])
+	}
+
+	return newSnapshot(AlgorithmBucket, atomic.LoadInt64(&bl.limit), bl.LastUpdate(), bucketState{
+		MinBucketID: bl.minBucketID,
+		Buckets:     buckets,
+	})
+}
+
+// Restore loads bucket counters from snapshot. Buckets older than tracked ones are discarded.
+// Snapshot must be taken by limiter with the same bucket interval.
+func (bl *BucketLimiter) Restore(s Snapshot) error {
+	var st bucketState
+	if err := unmarshalState(s, AlgorithmBucket, &st); err != nil {
+		return err
+	}
+	if len(st.Buckets) == 0 {
+		return nil
+	}
+	bl.touch(s.LastUpdate)
+
+	// snapshot can contain buckets newer than the first event of restored limiter.
+	maxID := st.MinBucketID + int64(len(st.Buckets)) - 1
+	bl.shift(maxID)
+
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	for i, v := range st.Buckets {
+		j := st.MinBucketID + int64(i) - bl.minBucketID
+		if j < 0 || j >= int64(len(bl.buckets)) {
+			continue
+		}
+		atomic.StoreInt64(&bl.buckets[j], v)
+	}
+
+	return nil
+}
+
 // SetLimit updates limit value.
 // Note: it's allowed only to change limit, not bucketInterval.
 func (bl *BucketLimiter) SetLimit(limit int64) {
-	bl.mu.Lock()
-	bl.limit = limit
-	bl.mu.Unlock()
+	atomic.StoreInt64(&bl.limit, limit)
 }
 
-// increment adds 1 to specified bucket.
-// Note: this func is not thread safe, so it must be guarded with lock.
-func (сl *BucketLimiter) increment(index int64) bool {
-	i := index - сl.minBucketID
-	if сl.buckets[i] >= int64(сl.limit) {
-		return false
+// increment adds n to specified bucket if it doesn't exceed limit.
+// Note: this func must be guarded with read lock.
+func (bl *BucketLimiter) increment(index, n, limit int64) bool {
+	i := index - bl.minBucketID
+	if n == 0 {
+		return true
+	}
+
+	for {
+		v := atomic.LoadInt64(&bl.buckets[i])
+		if v+n > limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&bl.buckets[i], v, v+n) {
+			return true
+		}
+	}
+}
+
+// unixNanoToTime converts unix nanoseconds to time. Zero value means that time is not set.
+func unixNanoToTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n)
+}
+
+// utilization returns used part of limit.
+func utilization(used, limit int64) float64 {
+	if limit <= 0 {
+		return 1
 	}
-	сl.buckets[i]++
 
-	return true
+	return float64(used) / float64(limit)
 }
 
 func progress(w io.Writer, current, limit, max int64) {
@@ -0,0 +1,88 @@
+package throttleplugin
+
+import (
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/pkg/errors"
+)
+
+// ClassConfig defines priority classes of events sharing the same limiter.
+//
+// Shares maps string value of Field to part of limit available to the class. Events of class
+// with share 0.5 are throttled when limiter is half full, so the rest of limit is reserved for
+// classes with higher share. Default is used if Field is missing or its value isn't found in Shares.
+type ClassConfig struct {
+	Field   string             `yaml:"field"`
+	Shares  map[string]float64 `yaml:"shares"`
+	Default *float64           `yaml:"default"`
+}
+
+// Classes calculates part of limit available to event.
+type Classes struct {
+	field  string
+	shares map[string]float64
+	def    float64
+}
+
+// NewClasses returns new Classes instance. Nil config means that whole limit is available to every event.
+func NewClasses(c *ClassConfig) (Classes, error) {
+	if c == nil {
+		return Classes{def: 1}, nil
+	}
+
+	classes := Classes{
+		field:  c.Field,
+		shares: c.Shares,
+		def:    1,
+	}
+	if c.Default != nil {
+		classes.def = *c.Default
+	}
+
+	if !validShare(classes.def) {
+		return Classes{}, errors.Errorf("default share must be in (0, 1] range: %v", classes.def)
+	}
+	for class, share := range c.Shares {
+		if !validShare(share) {
+			return Classes{}, errors.Errorf("share of class %q must be in (0, 1] range: %v", class, share)
+		}
+	}
+
+	return classes, nil
+}
+
+// Share returns part of limit available to event.
+func (c Classes) Share(e *beat.Event) float64 {
+	if c.field == "" {
+		return c.def
+	}
+
+	v, err := e.GetValue(c.field)
+	if err != nil {
+		return c.def
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return c.def
+	}
+
+	share, ok := c.shares[s]
+	if !ok {
+		return c.def
+	}
+
+	return share
+}
+
+func validShare(share float64) bool {
+	return share > 0 && share <= 1
+}
+
+// shareOf returns part of limit available to class with specified share.
+func shareOf(limit int64, share float64) int64 {
+	if share >= 1 {
+		return limit
+	}
+
+	return int64(float64(limit) * share)
+}
@@ -0,0 +1,42 @@
+package throttleplugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClasses_Share(t *testing.T) {
+	half := 0.5
+
+	cases := []struct {
+		name   string
+		cfg    *ClassConfig
+		fields map[string]interface{}
+		share  float64
+	}{
+		{"no config", nil, map[string]interface{}{"level": "debug"}, 1},
+		{"lookup", &ClassConfig{Field: "level", Shares: map[string]float64{"debug": 0.2}}, map[string]interface{}{"level": "debug"}, 0.2},
+		{"lookup default", &ClassConfig{Field: "level", Shares: map[string]float64{"debug": 0.2}}, map[string]interface{}{"level": "error"}, 1},
+		{"custom default", &ClassConfig{Field: "level", Default: &half}, map[string]interface{}{}, 0.5},
+		{"not a string", &ClassConfig{Field: "level", Shares: map[string]float64{"1": 0.2}}, map[string]interface{}{"level": 1}, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			classes, err := NewClasses(c.cfg)
+			assert.NoError(t, err)
+			assert.Equal(t, c.share, classes.Share(newTestEvent(c.fields)))
+		})
+	}
+}
+
+func TestNewClasses_Invalid(t *testing.T) {
+	zero := 0.0
+
+	_, err := NewClasses(&ClassConfig{Field: "level", Shares: map[string]float64{"debug": 1.5}})
+	assert.Error(t, err)
+
+	_, err = NewClasses(&ClassConfig{Field: "level", Default: &zero})
+	assert.Error(t, err)
+}
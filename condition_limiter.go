@@ -16,7 +16,7 @@ type ConditionLimiter struct {
 	keys      []string          // sorted list of used keys is used for combining limiter key.
 	fields    map[string]string // used only for WriteStatus functionality, because it's hard to pretty print conditions.
 
-	bl *BucketLimiter
+	bl Limiter
 }
 
 // NewConditionLimiter returns new ConditionLimiter instance.
@@ -58,7 +58,7 @@ func (cl *ConditionLimiter) Check(e *beat.Event) bool {
 
 // Allow returns TRUE if event is allowed to be processed.
 func (cl *ConditionLimiter) Allow(t time.Time) bool {
-	return cl.bl.Allow(t)
+	return cl.bl.Allow(t, 1)
 }
 
 func prepareFields(m map[string]string) map[string]interface{} {
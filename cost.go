@@ -0,0 +1,98 @@
+package throttleplugin
+
+import (
+	"strconv"
+
+	"github.com/elastic/beats/libbeat/beat"
+)
+
+// CostConfig defines how many tokens event takes from bucket.
+//
+// If Values are specified, cost is looked up by string value of Field. Otherwise, Field must
+// contain numeric cost of event. Default is used if Field is missing or its value isn't
+// found in Values or isn't a number.
+type CostConfig struct {
+	Field   string           `yaml:"field"`
+	Values  map[string]int64 `yaml:"values"`
+	Default *int64           `yaml:"default"`
+}
+
+// Cost calculates number of tokens required by event.
+type Cost struct {
+	field  string
+	values map[string]int64
+	def    int64
+}
+
+// NewCost returns new Cost instance. Nil config means that every event costs 1 token.
+func NewCost(c *CostConfig) Cost {
+	if c == nil {
+		return Cost{def: 1}
+	}
+
+	cost := Cost{
+		field:  c.Field,
+		values: c.Values,
+		def:    1,
+	}
+	if c.Default != nil {
+		cost.def = *c.Default
+	}
+
+	return cost
+}
+
+// Of returns cost of event. Cost is never negative.
+func (c Cost) Of(e *beat.Event) int64 {
+	if c.field == "" {
+		return c.def
+	}
+
+	v, err := e.GetValue(c.field)
+	if err != nil {
+		return c.def
+	}
+
+	n, ok := c.lookup(v)
+	if !ok || n < 0 {
+		return c.def
+	}
+
+	return n
+}
+
+func (c Cost) lookup(v interface{}) (int64, bool) {
+	if c.values != nil {
+		s, ok := v.(string)
+		if !ok {
+			return 0, false
+		}
+
+		n, ok := c.values[s]
+		return n, ok
+	}
+
+	switch t := v.(type) {
+	case int:
+		return int64(t), true
+	case int32:
+		return int64(t), true
+	case int64:
+		return t, true
+	case uint:
+		return int64(t), true
+	case uint32:
+		return int64(t), true
+	case uint64:
+		return int64(t), true
+	case float32:
+		return int64(t), true
+	case float64:
+		return int64(t), true
+	case string:
+		n, err := strconv.ParseInt(t, 10, 64)
+		return n, err == nil
+	}
+
+	return 0, false
+}
@@ -0,0 +1,35 @@
+package throttleplugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCost_Of(t *testing.T) {
+	zero := int64(0)
+	five := int64(5)
+
+	cases := []struct {
+		name   string
+		cfg    *CostConfig
+		fields map[string]interface{}
+		cost   int64
+	}{
+		{"no config", nil, map[string]interface{}{"weight": 10}, 1},
+		{"lookup", &CostConfig{Field: "level", Values: map[string]int64{"debug": 1, "error": 0}}, map[string]interface{}{"level": "error"}, 0},
+		{"lookup default", &CostConfig{Field: "level", Values: map[string]int64{"error": 0}}, map[string]interface{}{"level": "info"}, 1},
+		{"custom default", &CostConfig{Field: "level", Values: map[string]int64{"error": 0}, Default: &five}, map[string]interface{}{}, 5},
+		{"numeric", &CostConfig{Field: "weight"}, map[string]interface{}{"weight": 10}, 10},
+		{"numeric float", &CostConfig{Field: "weight"}, map[string]interface{}{"weight": 2.5}, 2},
+		{"numeric string", &CostConfig{Field: "weight"}, map[string]interface{}{"weight": "7"}, 7},
+		{"not a number", &CostConfig{Field: "weight", Default: &zero}, map[string]interface{}{"weight": "foo"}, 0},
+		{"negative", &CostConfig{Field: "weight"}, map[string]interface{}{"weight": -3}, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.cost, NewCost(c.cfg).Of(newTestEvent(c.fields)))
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package throttleplugin
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/common/file"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DeadLetterConfig defines dead-letter file for throttled events.
+type DeadLetterConfig struct {
+	Path       string        `config:"path"`
+	MaxSize    uint          `config:"max_size"`    // maximum file size in bytes before rotation.
+	MaxBackups uint          `config:"max_backups"` // maximum number of rotated files.
+	Interval   time.Duration `config:"interval"`    // rotate file every interval regardless of size.
+	SampleRate int64         `config:"sample_rate"` // write only 1 of SampleRate events.
+}
+
+// deadLetterRecord is a line of dead-letter file.
+type deadLetterRecord struct {
+	Timestamp time.Time     `json:"@timestamp"`
+	Rule      string        `json:"rule"`
+	Key       string        `json:"key"`
+	Fields    common.MapStr `json:"fields"`
+}
+
+// DeadLetterSink writes throttled events as NDJSON to size and age rotated file.
+type DeadLetterSink struct {
+	w          io.WriteCloser
+	sampleRate int64
+	seen       int64 // number of events passed to Write.
+
+	writes prometheus.Counter
+	errors prometheus.Counter
+}
+
+// NewDeadLetterSink returns new DeadLetterSink instance.
+// writes and errs are incremented on every written event and every write error.
+func NewDeadLetterSink(c DeadLetterConfig, writes, errs prometheus.Counter) (*DeadLetterSink, error) {
+	opts := []file.RotatorOption{
+		file.Permissions(0600),
+		file.Interval(c.Interval),
+	}
+	if c.MaxSize > 0 {
+		opts = append(opts, file.MaxSizeBytes(c.MaxSize))
+	}
+	if c.MaxBackups > 0 {
+		opts = append(opts, file.MaxBackups(c.MaxBackups))
+	}
+
+	r, err := file.NewFileRotator(c.Path, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dead-letter file rotator")
+	}
+
+	sampleRate := c.SampleRate
+	if sampleRate <= 0 {
+		sampleRate = 1
+	}
+
+	return &DeadLetterSink{
+		w:          r,
+		sampleRate: sampleRate,
+		writes:     writes,
+		errors:     errs,
+	}, nil
+}
+
+// Write writes event rejected by limiter.
+func (s *DeadLetterSink) Write(d Decision, e *beat.Event) {
+	if (atomic.AddInt64(&s.seen, 1)-1)%s.sampleRate != 0 {
+		return
+	}
+
+	b, err := json.Marshal(deadLetterRecord{
+		Timestamp: e.Timestamp,
+		Rule:      d.Rule,
+		Key:       d.Key,
+		Fields:    e.Fields,
+	})
+	if err != nil {
+		s.errors.Inc()
+		return
+	}
+
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		s.errors.Inc()
+		return
+	}
+	s.writes.Inc()
+}
+
+// Close closes dead-letter file.
+func (s *DeadLetterSink) Close() error {
+	return s.w.Close()
+}
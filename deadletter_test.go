@@ -0,0 +1,100 @@
+package throttleplugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDeadLetterCounters() (writes, errs prometheus.Counter) {
+	writes = prometheus.NewCounter(prometheus.CounterOpts{Name: "writes", Help: "writes"})
+	errs = prometheus.NewCounter(prometheus.CounterOpts{Name: "errors", Help: "errors"})
+
+	return writes, errs
+}
+
+func readLines(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines []map[string]interface{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var m map[string]interface{}
+		if err := json.Unmarshal(s.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, m)
+	}
+
+	return lines
+}
+
+func TestDeadLetterSink_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "throttled.ndjson")
+	writes, errs := newDeadLetterCounters()
+	s, err := NewDeadLetterSink(DeadLetterConfig{Path: path, SampleRate: 2}, writes, errs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		e := &beat.Event{Timestamp: ts, Fields: common.MapStr{"message": "foo", "n": i}}
+		s.Write(Decision{Rule: "rule", Key: "key"}, e)
+	}
+	assert.NoError(t, s.Close())
+
+	assert.Equal(t, []map[string]interface{}{
+		{"@timestamp": "2018-12-19T19:30:25Z", "rule": "rule", "key": "key", "fields": map[string]interface{}{"message": "foo", "n": 0.0}},
+		{"@timestamp": "2018-12-19T19:30:25Z", "rule": "rule", "key": "key", "fields": map[string]interface{}{"message": "foo", "n": 2.0}},
+	}, readLines(t, path))
+	assert.Equal(t, 2.0, testutil.ToFloat64(writes))
+	assert.Equal(t, 0.0, testutil.ToFloat64(errs))
+}
+
+func TestDeadLetterSink_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "throttled.ndjson")
+	writes, errs := newDeadLetterCounters()
+	s, err := NewDeadLetterSink(DeadLetterConfig{Path: path, MaxSize: 200, MaxBackups: 2}, writes, errs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		s.Write(Decision{Rule: "rule", Key: "key"}, &beat.Event{Fields: common.MapStr{"message": "some long message"}})
+	}
+	// event is larger than max file size.
+	s.Write(Decision{}, &beat.Event{Fields: common.MapStr{"message": string(make([]byte, 300))}})
+	assert.NoError(t, s.Close())
+
+	files, _ := filepath.Glob(path + "*")
+	assert.Len(t, files, 3)
+	assert.Equal(t, 10.0, testutil.ToFloat64(writes))
+	assert.Equal(t, 1.0, testutil.ToFloat64(errs))
+}
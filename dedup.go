@@ -0,0 +1,263 @@
+package throttleplugin
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+const (
+	// DefaultDedupWindow is used if dedup window is not specified.
+	DefaultDedupWindow = time.Minute
+	// DefaultDedupMaxMessages is used if maximum number of tracked messages is not specified.
+	DefaultDedupMaxMessages = 100000
+)
+
+// DuplicatesField is added to events emitted when dedup window closes.
+const DuplicatesField = "throttle.duplicates"
+
+var (
+	uuidPattern   = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	numberPattern = regexp.MustCompile(`[0-9]+`)
+)
+
+// DedupConfig defines suppression of duplicate messages.
+type DedupConfig struct {
+	Field     string        `config:"field"`     // field used to fingerprint events, "message" by default.
+	Window    time.Duration `config:"window"`    // repeats are suppressed during window after the first occurrence.
+	Normalize bool          `config:"normalize"` // replace numbers and UUIDs before fingerprinting.
+
+	MaxMessages int `config:"max_messages"` // maximum number of tracked messages, new messages aren't suppressed when it's reached.
+}
+
+// Deduplicator suppresses repeated messages per limiter key and builds events with number of
+// suppressed duplicates when dedup window closes.
+//
+// Most messages are unique, so only fingerprint is tracked for the first occurrence and event fields
+// are kept only when the first duplicate is suppressed.
+// Like summaries, event is emitted in place of one of the next duplicates or returned by Flush.
+type Deduplicator struct {
+	mu          sync.Mutex
+	field       string
+	window      time.Duration
+	normalize   bool
+	maxMessages int
+	windows     map[dedupKey]*dedupWindow
+	ready       []*dedupWindow // closed windows with suppressed duplicates waiting to be emitted, ordered by close time.
+	nextCheck   time.Time
+	nextFlush   int64 // unix nanoseconds of the next Flush check, accessed atomically.
+	untracked   int64 // number of messages not tracked because of maxMessages, accessed atomically.
+}
+
+type dedupKey struct {
+	key         string // limiter key.
+	fingerprint uint64
+}
+
+// dedupWindow contains information about duplicates of one message.
+type dedupWindow struct {
+	key        string
+	rule       string
+	fields     common.MapStr // fields of the first suppressed duplicate, nil if there are no duplicates.
+	start      time.Time
+	end        time.Time // time when window is closed.
+	suppressed int64
+}
+
+// NewDeduplicator returns new Deduplicator instance.
+func NewDeduplicator(c DedupConfig) *Deduplicator {
+	dd := &Deduplicator{
+		field:       c.Field,
+		window:      c.Window,
+		normalize:   c.Normalize,
+		maxMessages: c.MaxMessages,
+		windows:     make(map[dedupKey]*dedupWindow),
+	}
+	if dd.field == "" {
+		dd.field = DefaultSizeField
+	}
+	if dd.window <= 0 {
+		dd.window = DefaultDedupWindow
+	}
+	if dd.maxMessages <= 0 {
+		dd.maxMessages = DefaultDedupMaxMessages
+	}
+
+	return dd
+}
+
+// Duplicate returns TRUE if event e is a repeat of event passed with the same limiter key during current window.
+// Events without fingerprinted field are never treated as duplicates.
+// key isn't retained, so it can point to reusable buffer.
+func (dd *Deduplicator) Duplicate(key []byte, rule string, e *beat.Event, now time.Time) bool {
+	fp, ok := dd.fingerprint(e)
+	if !ok {
+		return false
+	}
+
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	dd.collect(now)
+
+	// conversion in lookup doesn't allocate.
+	if w, ok := dd.windows[dedupKey{key: string(key), fingerprint: fp}]; ok {
+		if now.Sub(w.start) < dd.window {
+			if w.suppressed == 0 {
+				w.fields = e.Fields.Clone()
+			}
+			w.suppressed++
+			return true
+		}
+		dd.close(dedupKey{key: w.key, fingerprint: fp}, w, now)
+	}
+
+	if len(dd.windows) >= dd.maxMessages {
+		atomic.AddInt64(&dd.untracked, 1)
+		return false
+	}
+
+	k := dedupKey{key: string(key), fingerprint: fp}
+	dd.windows[k] = &dedupWindow{
+		key:   k.key,
+		rule:  rule,
+		start: now,
+	}
+
+	return false
+}
+
+// Untracked returns number of messages that weren't tracked because maximum number of messages was reached.
+func (dd *Deduplicator) Untracked() int64 {
+	return atomic.LoadInt64(&dd.untracked)
+}
+
+// Next returns event for one of closed windows with suppressed duplicates or nil if there are no such windows.
+func (dd *Deduplicator) Next(now time.Time) *beat.Event {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	dd.collect(now)
+	if len(dd.ready) == 0 {
+		return nil
+	}
+
+	w := dd.ready[0]
+	dd.ready[0] = nil
+	dd.ready = dd.ready[1:]
+
+	return w.event()
+}
+
+// Flush closes expired windows and returns events that weren't emitted in place of duplicates
+// during window after their windows are closed, so counts of messages that stopped repeating aren't lost.
+// It's called periodically and on passed events.
+func (dd *Deduplicator) Flush(now time.Time) []*beat.Event {
+	// Flush is called on passed events, so lock isn't taken more often than summaryCheckInterval.
+	if now.UnixNano() < atomic.LoadInt64(&dd.nextFlush) {
+		return nil
+	}
+
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	dd.collect(now)
+	atomic.StoreInt64(&dd.nextFlush, dd.nextCheck.UnixNano())
+
+	var events []*beat.Event
+	for len(dd.ready) > 0 && now.Sub(dd.ready[0].end) >= dd.window {
+		events = append(events, dd.ready[0].event())
+		dd.ready[0] = nil
+		dd.ready = dd.ready[1:]
+	}
+
+	return events
+}
+
+// Drain closes all windows and returns events for windows with suppressed duplicates. It's used on shutdown.
+func (dd *Deduplicator) Drain(now time.Time) []*beat.Event {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	for k, w := range dd.windows {
+		dd.close(k, w, now)
+	}
+
+	events := make([]*beat.Event, 0, len(dd.ready))
+	for _, w := range dd.ready {
+		events = append(events, w.event())
+	}
+	dd.ready = nil
+
+	return events
+}
+
+// collect closes expired windows. Windows are looked up not often than summaryCheckInterval.
+// Note: this func is not thread safe, so it must be guarded with lock.
+func (dd *Deduplicator) collect(now time.Time) {
+	if now.Before(dd.nextCheck) {
+		return
+	}
+	dd.nextCheck = now.Add(summaryCheckInterval)
+
+	for k, w := range dd.windows {
+		if now.Sub(w.start) >= dd.window {
+			dd.close(k, w, now)
+		}
+	}
+}
+
+// close removes window and queues it to be emitted if it has suppressed duplicates.
+// Note: this func is not thread safe, so it must be guarded with lock.
+func (dd *Deduplicator) close(k dedupKey, w *dedupWindow, now time.Time) {
+	delete(dd.windows, k)
+	if w.suppressed > 0 {
+		w.end = now
+		dd.ready = append(dd.ready, w)
+	}
+}
+
+// fingerprint returns hash of fingerprinted field.
+func (dd *Deduplicator) fingerprint(e *beat.Event) (uint64, bool) {
+	v, err := e.GetValue(dd.field)
+	if err != nil {
+		return 0, false
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		s = fmt.Sprint(v)
+	}
+	if dd.normalize {
+		s = normalizeMessage(s)
+	}
+
+	return hashString(s), true
+}
+
+// normalizeMessage replaces UUIDs and numbers, so messages that differ only by ids are treated as duplicates.
+func normalizeMessage(s string) string {
+	s = uuidPattern.ReplaceAllLiteralString(s, "<uuid>")
+	return numberPattern.ReplaceAllLiteralString(s, "<n>")
+}
+
+// event builds event with number of suppressed duplicates.
+func (w *dedupWindow) event() *beat.Event {
+	fields := w.fields
+	fields["throttle"] = common.MapStr{
+		"duplicates": w.suppressed,
+		"key":        w.key,
+		"rule":       w.rule,
+		"window":     common.MapStr{"start": w.start, "end": w.end},
+	}
+
+	return &beat.Event{
+		Timestamp: w.end,
+		Fields:    fields,
+	}
+}
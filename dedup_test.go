@@ -0,0 +1,115 @@
+package throttleplugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicator(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	dd := NewDeduplicator(DedupConfig{})
+
+	e := newTestEvent(map[string]interface{}{"message": "foo", "app": "foo"})
+	other := newTestEvent(map[string]interface{}{"message": "bar", "app": "foo"})
+
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", e, now))
+	assert.True(t, dd.Duplicate([]byte("key"), "rule", e, now.Add(time.Second)))
+	assert.True(t, dd.Duplicate([]byte("key"), "rule", e, now.Add(2*time.Second)))
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", other, now), "different messages must not be suppressed")
+	assert.False(t, dd.Duplicate([]byte("other"), "rule", e, now), "different limiter keys must not be suppressed")
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", newTestEvent(nil), now))
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", newTestEvent(nil), now), "events without message must be passed")
+
+	assert.Nil(t, dd.Next(now.Add(30*time.Second)), "window must be still open")
+
+	end := now.Add(61 * time.Second)
+	s := dd.Next(end)
+	if assert.NotNil(t, s) {
+		assert.Equal(t, end, s.Timestamp)
+		assert.Equal(t, common.MapStr{
+			"app":     "foo",
+			"message": "foo",
+			"throttle": common.MapStr{
+				"duplicates": int64(2),
+				"key":        "key",
+				"rule":       "rule",
+				"window":     common.MapStr{"start": now, "end": end},
+			},
+		}, s.Fields)
+	}
+	assert.Nil(t, dd.Next(end), "windows without duplicates must not be emitted")
+
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", e, end), "new window must be opened")
+}
+
+func TestDeduplicator_Normalize(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	dd := NewDeduplicator(DedupConfig{Normalize: true})
+
+	first := newTestEvent(map[string]interface{}{"message": "request 1f0c6bb2-2ba4-4a53-a7b9-5c8f0e3bf1d2 failed after 120ms"})
+	second := newTestEvent(map[string]interface{}{"message": "request 9a1e0d4c-8f3b-4e2a-b6c1-0d9e8f7a6b5c failed after 35ms"})
+
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", first, now))
+	assert.True(t, dd.Duplicate([]byte("key"), "rule", second, now))
+	assert.Equal(t, "request <uuid> failed after <n>ms", normalizeMessage(first.Fields["message"].(string)))
+}
+
+func TestDeduplicator_FieldsKeptForDuplicates(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	dd := NewDeduplicator(DedupConfig{})
+
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", newTestEvent(map[string]interface{}{"message": "foo"}), now))
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", newTestEvent(map[string]interface{}{"message": "bar"}), now))
+	for _, w := range dd.windows {
+		assert.Nil(t, w.fields, "fields of unique messages must not be kept")
+	}
+
+	assert.True(t, dd.Duplicate([]byte("key"), "rule", newTestEvent(map[string]interface{}{"message": "foo"}), now))
+	assert.Len(t, dd.windows, 2)
+	for k, w := range dd.windows {
+		assert.Equal(t, w.suppressed > 0, w.fields != nil, "fields must be kept only for window with duplicates %v", k)
+	}
+}
+
+func TestDeduplicator_MaxMessages(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	dd := NewDeduplicator(DedupConfig{MaxMessages: 1})
+
+	foo := newTestEvent(map[string]interface{}{"message": "foo"})
+	bar := newTestEvent(map[string]interface{}{"message": "bar"})
+
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", foo, now))
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", bar, now))
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", bar, now), "messages over limit must not be tracked")
+	assert.True(t, dd.Duplicate([]byte("key"), "rule", foo, now))
+	assert.Len(t, dd.windows, 1)
+	assert.Equal(t, int64(2), dd.Untracked())
+}
+
+func TestDeduplicator_Flush(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	dd := NewDeduplicator(DedupConfig{})
+
+	e := newTestEvent(map[string]interface{}{"message": "foo"})
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", e, now))
+	assert.True(t, dd.Duplicate([]byte("key"), "rule", e, now))
+
+	// message stops repeating, so there are no duplicates to emit event in place of.
+	closed := now.Add(time.Minute)
+	assert.Empty(t, dd.Flush(closed), "event must wait for duplicate during window")
+	assert.Empty(t, dd.windows)
+
+	events := dd.Flush(closed.Add(time.Minute))
+	if assert.Len(t, events, 1) {
+		duplicates, _ := events[0].GetValue("throttle.duplicates")
+		assert.Equal(t, int64(1), duplicates)
+	}
+	assert.Nil(t, dd.Next(closed.Add(time.Hour)), "flushed event must not be emitted twice")
+
+	assert.False(t, dd.Duplicate([]byte("key"), "rule", e, closed.Add(time.Hour)))
+	assert.True(t, dd.Duplicate([]byte("key"), "rule", e, closed.Add(time.Hour)))
+	assert.Len(t, dd.Drain(closed.Add(time.Hour)), 1, "open windows with duplicates must be drained")
+}
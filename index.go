@@ -0,0 +1,173 @@
+package throttleplugin
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/pkg/errors"
+)
+
+// Supported strategies of choosing rule when several rules match event.
+const (
+	// MatchFirst selects rule with highest priority. Rules with equal priority are checked in order of definition.
+	MatchFirst = "first"
+	// MatchMostSpecific selects rule with the largest number of selectors. Ties are resolved like in MatchFirst.
+	MatchMostSpecific = "most_specific"
+	// MatchAll applies all matched rules: event is allowed only if all of them allow it.
+	MatchAll = "all"
+)
+
+// RuleIndex is used to find matched rules without iterating over all rules.
+//
+// Rules are grouped by set of selector fields. Each group contains hash map from encoded
+// selector values to rule positions, so matching cost depends only on number of distinct
+// selector field sets, not on number of rules.
+type RuleIndex struct {
+	strategy string
+	rules    []Rule // sorted by rank: rule with lower position wins.
+	def      Rule   // used when no rules are matched.
+	groups   []ruleGroup
+}
+
+type ruleGroup struct {
+	keys  []string         // sorted list of selector fields.
+	rules map[string][]int // encoded selector values -> sorted positions of rules with these values.
+}
+
+// NewRuleIndex compiles rules into index according to match strategy.
+// def rule is used for events that don't match any of rules.
+func NewRuleIndex(rules []Rule, def Rule, strategy string) (*RuleIndex, error) {
+	sorted := make([]Rule, len(rules))
+	copy(sorted, rules)
+
+	switch strategy {
+	case "", MatchFirst:
+		strategy = MatchFirst
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].priority > sorted[j].priority
+		})
+	case MatchMostSpecific:
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if len(sorted[i].keys) != len(sorted[j].keys) {
+				return len(sorted[i].keys) > len(sorted[j].keys)
+			}
+			return sorted[i].priority > sorted[j].priority
+		})
+	case MatchAll:
+		// the broadest rules go first, so matched rules are ordered like namespace -> deployment -> container.
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if len(sorted[i].keys) != len(sorted[j].keys) {
+				return len(sorted[i].keys) < len(sorted[j].keys)
+			}
+			return sorted[i].priority > sorted[j].priority
+		})
+	default:
+		return nil, errors.Errorf("unknown match strategy: %q", strategy)
+	}
+
+	idx := &RuleIndex{
+		strategy: strategy,
+		rules:    sorted,
+		def:      def,
+	}
+	groups := make(map[string]int)
+
+	for i, r := range sorted {
+		// keys are already sorted, so they can be used as group id.
+		id := strings.Join(r.keys, "\x00")
+		gi, ok := groups[id]
+		if !ok {
+			gi = len(idx.groups)
+			groups[id] = gi
+			idx.groups = append(idx.groups, ruleGroup{
+				keys:  r.keys,
+				rules: make(map[string][]int),
+			})
+		}
+
+		var buf []byte
+		for _, v := range r.values {
+			buf = appendKeyValue(buf, v)
+		}
+
+		g := idx.groups[gi]
+		g.rules[string(buf)] = append(g.rules[string(buf)], i)
+	}
+
+	return idx, nil
+}
+
+// Rules returns list of indexed rules in order of their rank.
+func (idx *RuleIndex) Rules() []Rule {
+	return idx.rules
+}
+
+// Strategy returns match strategy.
+func (idx *RuleIndex) Strategy() string {
+	return idx.strategy
+}
+
+// Match appends matched rules to dst. If no rules are matched, default rule is appended.
+// For MatchAll strategy all matched rules are appended in order of their rank, otherwise only the winner.
+func (idx *RuleIndex) Match(e *beat.Event, dst []*Rule) []*Rule {
+	var (
+		arr [256]byte
+		all [16]int
+	)
+
+	matched := all[:0]
+	for _, g := range idx.groups {
+		buf, ok := appendEventValues(arr[:0], e, g.keys)
+		if !ok {
+			continue
+		}
+
+		positions, ok := g.rules[string(buf)]
+		if !ok {
+			continue
+		}
+
+		if idx.strategy == MatchAll {
+			matched = append(matched, positions...)
+			continue
+		}
+
+		if len(matched) == 0 {
+			matched = append(matched, positions[0])
+		} else if positions[0] < matched[0] {
+			matched[0] = positions[0]
+		}
+	}
+
+	if len(matched) == 0 {
+		return append(dst, &idx.def)
+	}
+
+	sort.Ints(matched)
+	for _, i := range matched {
+		dst = append(dst, &idx.rules[i])
+	}
+
+	return dst
+}
+
+// appendEventValues appends encoded values of event fields to buf.
+// Only string values are supported, so FALSE is returned if some field is missing or not a string.
+func appendEventValues(buf []byte, e *beat.Event, keys []string) ([]byte, bool) {
+	for _, k := range keys {
+		v, err := e.GetValue(k)
+		if err != nil {
+			return buf, false
+		}
+
+		sv, ok := v.(string)
+		if !ok {
+			return buf, false
+		}
+
+		buf = appendKeyValue(buf, sv)
+	}
+
+	return buf, true
+}
@@ -0,0 +1,154 @@
+package throttleplugin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPriorityRule(fields map[string]string, limit, priority int64) Rule {
+	r, _ := newRuleFromConfig(RuleConfig{Selectors: fields, Limit: limit, Priority: priority})
+	return r
+}
+
+func newTestEvent(fields map[string]interface{}) *beat.Event {
+	event := &beat.Event{Fields: common.MapStr{}}
+	for k, v := range fields {
+		event.PutValue(k, v)
+	}
+
+	return event
+}
+
+func matchedLimits(idx *RuleIndex, e *beat.Event) []int64 {
+	var limits []int64
+	for _, r := range idx.Match(e, nil) {
+		limits = append(limits, r.Limit())
+	}
+
+	return limits
+}
+
+func TestRuleIndex_Match(t *testing.T) {
+	rules := []Rule{
+		NewRule(map[string]string{"a": "1", "b": "2"}, 10),
+		NewRule(map[string]string{"a": "1"}, 20),
+		NewRule(map[string]string{"a": "1", "b": "3"}, 30),
+		NewRule(map[string]string{"a": "1"}, 40),
+	}
+	idx, err := NewRuleIndex(rules, NewRule(map[string]string{}, 50), "")
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name   string
+		fields map[string]interface{}
+		limit  int64
+	}{
+		{"first rule", map[string]interface{}{"a": "1", "b": "2"}, 10},
+		{"rules order is preserved", map[string]interface{}{"a": "1", "b": "3"}, 20},
+		{"duplicate", map[string]interface{}{"a": "1"}, 20},
+		{"default", map[string]interface{}{"a": "2", "b": "2"}, 50},
+		{"not a string", map[string]interface{}{"a": 1}, 50},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, []int64{c.limit}, matchedLimits(idx, newTestEvent(c.fields)))
+		})
+	}
+}
+
+func TestRuleIndex_MatchStrategy(t *testing.T) {
+	rules := []Rule{
+		newPriorityRule(map[string]string{"ns": "a"}, 10, 0),
+		newPriorityRule(map[string]string{"ns": "a", "app": "foo"}, 20, 0),
+		newPriorityRule(map[string]string{"ns": "a", "app": "foo", "container": "c"}, 30, 0),
+		newPriorityRule(map[string]string{"app": "foo"}, 40, 1),
+	}
+	def := NewRule(map[string]string{}, 50)
+	event := newTestEvent(map[string]interface{}{"ns": "a", "app": "foo", "container": "c"})
+
+	cases := []struct {
+		strategy string
+		limits   []int64
+	}{
+		{MatchFirst, []int64{40}},
+		{MatchMostSpecific, []int64{30}},
+		{MatchAll, []int64{40, 10, 20, 30}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.strategy, func(t *testing.T) {
+			idx, err := NewRuleIndex(rules, def, c.strategy)
+			assert.NoError(t, err)
+			assert.Equal(t, c.strategy, idx.Strategy())
+			assert.Equal(t, c.limits, matchedLimits(idx, event))
+			assert.Equal(t, []int64{50}, matchedLimits(idx, newTestEvent(nil)))
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := NewRuleIndex(rules, def, "foo")
+		assert.Error(t, err)
+	})
+}
+
+func benchmarkRules(n int) []Rule {
+	rules := make([]Rule, 0, n)
+	for i := 0; i < n; i++ {
+		rules = append(rules, NewRule(map[string]string{
+			"kubernetes.namespace": fmt.Sprintf("ns-%d", i%100),
+			"kubernetes.container": fmt.Sprintf("container-%d", i),
+		}, int64(i)))
+	}
+
+	return rules
+}
+
+func benchmarkEvent() *beat.Event {
+	event := &beat.Event{Fields: common.MapStr{}}
+	event.PutValue("kubernetes.namespace", "ns-unknown")
+	event.PutValue("kubernetes.container", "container-unknown")
+	event.PutValue("message", "hello")
+
+	return event
+}
+
+func BenchmarkRuleIndex_Match(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 5000} {
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			idx, _ := NewRuleIndex(benchmarkRules(n), NewRule(map[string]string{}, 1), MatchFirst)
+			event := benchmarkEvent()
+			var arr [8]*Rule
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				idx.Match(event, arr[:0])
+			}
+		})
+	}
+}
+
+// BenchmarkLinearMatch is used as baseline for BenchmarkRuleIndex_Match.
+func BenchmarkLinearMatch(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 5000} {
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			rules := benchmarkRules(n)
+			event := benchmarkEvent()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, r := range rules {
+					if ok, _ := r.Match(event); ok {
+						break
+					}
+				}
+			}
+		})
+	}
+}
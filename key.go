@@ -0,0 +1,96 @@
+package throttleplugin
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/pkg/errors"
+)
+
+// Supported modes of handling events without partition key field.
+const (
+	// MissingKeyUnknown puts missing field into separate "unknown" partition.
+	MissingKeyUnknown = "unknown"
+	// MissingKeyDefault puts event into single default partition of the rule.
+	MissingKeyDefault = "default"
+	// MissingKeySkip excludes event from throttling.
+	MissingKeySkip = "skip"
+)
+
+const (
+	missingValueMarker = '-' // used instead of value if field is not present.
+	defaultKeyMarker   = '*' // used as whole partition key in MissingKeyDefault mode.
+	overflowKeyMarker  = '~' // used as whole partition key of shared limiter when limiters cap is reached.
+	bytesKeySuffix     = 'b' // appended to key of limiter that counts bytes.
+)
+
+// PartitionKey builds limiter partition key from event fields.
+//
+// Every field value is encoded as "<length>:<value>", so values can contain any characters
+// (including separators) without collisions between different combinations of values.
+// Missing fields are encoded with a marker that can't be a beginning of encoded value.
+type PartitionKey struct {
+	fields  []string
+	missing string
+}
+
+// NewPartitionKey returns new PartitionKey instance.
+func NewPartitionKey(fields []string, missing string) (PartitionKey, error) {
+	switch missing {
+	case "":
+		missing = MissingKeyUnknown
+	case MissingKeyUnknown, MissingKeyDefault, MissingKeySkip:
+	default:
+		return PartitionKey{}, errors.Errorf("unknown missing key mode: %q", missing)
+	}
+
+	return PartitionKey{
+		fields:  fields,
+		missing: missing,
+	}, nil
+}
+
+// Build returns encoded partition key for event.
+// ok is FALSE if event must be excluded from throttling.
+func (pk PartitionKey) Build(e *beat.Event) (key string, ok bool) {
+	buf, ok := pk.Append(nil, e)
+	return string(buf), ok
+}
+
+// Append appends encoded partition key for event to dst.
+// ok is FALSE if event must be excluded from throttling.
+func (pk PartitionKey) Append(dst []byte, e *beat.Event) (key []byte, ok bool) {
+	buf := dst
+	for _, f := range pk.fields {
+		v, err := e.GetValue(f)
+		if err != nil || v == nil {
+			switch pk.missing {
+			case MissingKeySkip:
+				return dst, false
+			case MissingKeyDefault:
+				return append(dst, defaultKeyMarker), true
+			}
+
+			buf = append(buf, missingValueMarker)
+			continue
+		}
+
+		sv, ok := v.(string)
+		if !ok {
+			sv = fmt.Sprintf("%v", v)
+		}
+
+		buf = appendKeyValue(buf, sv)
+	}
+
+	return buf, true
+}
+
+// appendKeyValue appends length-prefixed value to buf.
+func appendKeyValue(buf []byte, v string) []byte {
+	buf = strconv.AppendInt(buf, int64(len(v)), 10)
+	buf = append(buf, ':')
+
+	return append(buf, v...)
+}
@@ -0,0 +1,79 @@
+package throttleplugin
+
+import (
+	"testing"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPartitionKey(t *testing.T) {
+	pk, err := NewPartitionKey([]string{"a"}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, MissingKeyUnknown, pk.missing)
+
+	_, err = NewPartitionKey([]string{"a"}, "foo")
+	assert.Error(t, err)
+}
+
+func TestPartitionKey_Build(t *testing.T) {
+	event := &beat.Event{Fields: common.MapStr{}}
+	event.PutValue("a", "1")
+	event.PutValue("b", 2)
+
+	t.Run("no fields", func(t *testing.T) {
+		pk, _ := NewPartitionKey(nil, MissingKeyUnknown)
+		key, ok := pk.Build(event)
+
+		assert.True(t, ok)
+		assert.Equal(t, "", key)
+	})
+
+	t.Run("all fields present", func(t *testing.T) {
+		pk, _ := NewPartitionKey([]string{"a", "b"}, MissingKeyUnknown)
+		key, ok := pk.Build(event)
+
+		assert.True(t, ok)
+		assert.Equal(t, "1:11:2", key)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		pk, _ := NewPartitionKey([]string{"a", "c"}, MissingKeyUnknown)
+		key, ok := pk.Build(event)
+
+		assert.True(t, ok)
+		assert.Equal(t, "1:1-", key)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		pk, _ := NewPartitionKey([]string{"a", "c"}, MissingKeyDefault)
+		key, ok := pk.Build(event)
+
+		assert.True(t, ok)
+		assert.Equal(t, "*", key)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		pk, _ := NewPartitionKey([]string{"a", "c"}, MissingKeySkip)
+		_, ok := pk.Build(event)
+
+		assert.False(t, ok)
+	})
+
+	t.Run("no collisions", func(t *testing.T) {
+		pk, _ := NewPartitionKey([]string{"a", "b"}, MissingKeyUnknown)
+
+		e1 := &beat.Event{Fields: common.MapStr{}}
+		e1.PutValue("a", "x:")
+		e1.PutValue("b", "y")
+
+		e2 := &beat.Event{Fields: common.MapStr{}}
+		e2.PutValue("a", "x")
+		e2.PutValue("b", ":y")
+
+		k1, _ := pk.Build(e1)
+		k2, _ := pk.Build(e2)
+		assert.NotEqual(t, k1, k2)
+	})
+}
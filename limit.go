@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/elastic/beats/libbeat/beat"
@@ -16,74 +17,468 @@ import (
 )
 
 type RemoteConfig struct {
-	Key          string       `yaml:"key"`
-	DefaultLimit int64        `yaml:"default_limit"`
-	Rules        []RuleConfig `yaml:"rules"`
+	Key           string       `yaml:"key"` // deprecated: use Keys instead.
+	Keys          []string     `yaml:"keys"`
+	MissingKey    string       `yaml:"missing_key"`
+	MatchStrategy string       `yaml:"match_strategy"`
+	SizeField     string       `yaml:"size_field"`
+	DefaultLimit  int64        `yaml:"default_limit"`
+	DefaultBytes  int64        `yaml:"default_limit_bytes"`
+	Rules         []RuleConfig `yaml:"rules"`
 }
 
 type RuleConfig struct {
-	Limit     int64             `yaml:"limit"`
+	Name       string       `yaml:"name"`
+	Limit      int64        `yaml:"limit"`
+	LimitBytes int64        `yaml:"limit_bytes"`
+	Cost       *CostConfig  `yaml:"cost"`
+	Classes    *ClassConfig `yaml:"classes"`
+	Algorithm  string       `yaml:"algorithm"`
+	Burst      int64        `yaml:"burst"`
+
+	AlgorithmOptions map[string]interface{} `yaml:"algorithm_options"`
+
+	OverflowAction string `yaml:"overflow_action"`
+	SampleRate     int64  `yaml:"sample_rate"`
+	Annotate       bool   `yaml:"annotate"`
+	DeadLetter     bool   `yaml:"dead_letter"`
+
+	MaxDelay      time.Duration `yaml:"max_delay"`
+	DelayFallback string        `yaml:"delay_fallback"`
+
+	Priority  int64             `yaml:"priority"`
 	Selectors map[string]string `yaml:"selectors"`
 }
 
+// Policies for late events, which are older than window tracked by matched limiters,
+// i.e. than the latest event of limiters minus bucket_size * buckets.
+// Lateness doesn't depend on wall clock, so stream that lags behind is limited as usual.
+const (
+	LateDrop    = "drop"    // late events are rejected, overflow action of the narrowest matched rule is applied.
+	LateAllow   = "allow"   // late events are allowed without limiting.
+	LateCurrent = "current" // late events are counted against the latest bucket of limiters.
+)
+
+// policyRequestTimeout limits policy request, so stuck policy manager doesn't block updates forever.
+const policyRequestTimeout = 30 * time.Second
+
+// DefaultFutureTolerance is used if future tolerance is not specified.
+const DefaultFutureTolerance = 5 * time.Second
+
+// TimestampStats contains number of events with out-of-window timestamps.
+// Fields are accessed atomically.
+type TimestampStats struct {
+	Future      int64 // future timestamps clamped to now.
+	LateDropped int64 // late events rejected by LateDrop policy.
+	LateAllowed int64
+	LateCurrent int64 // late events counted against the current bucket.
+}
+
 type RemoteLimiter struct {
 	url            string
 	client         *http.Client
 	bucketInterval int64
 	buckets        int64
+	timestamp      *TimestampParser
+	stats          TimestampStats
+	overflows      int64 // accessed atomically, see LimiterStats.
+	reclaimed      int64 // accessed atomically, see LimiterStats.
+
+	mu       sync.Mutex   // serializes config updates.
+	config   atomic.Value // *limiterConfig, replaced on update, so events are processed without locks.
+	limiters *limiterMap
+
+	restoreMu      sync.Mutex
+	snapshots      map[string]Snapshot // saved limiters state waiting for limiters to be created, see LoadState.
+	restorePending int32               // accessed atomically, 1 if snapshots isn't empty, so restore skips restoreMu otherwise.
+}
+
+// limiterConfig is immutable set of policies used to process events.
+type limiterConfig struct {
+	key       PartitionKey
+	sizeField string
+	rules     *RuleIndex // nil if policies are not loaded yet.
+
+	futureTolerance time.Duration // timestamps later than now + futureTolerance are clamped to now.
+	latePolicy      string
+}
+
+// limiterEntry contains limiter and its metadata.
+type limiterEntry struct {
+	Limiter
+	key      string // limiter key.
+	rule     string // name of rule that created limiter.
+	bytes    bool   // limiter counts bytes, not events.
+	overflow int64  // number of events rejected by limiter, used for sampling. Accessed atomically.
+
+	hash   uint64        // key hash.
+	next   *limiterEntry // next limiter with the same key hash, see limiterMap.
+	capped bool          // limiter is counted against limiters cap, shared overflow limiters are not.
+
+	// LRU list of capped limiters, guarded by shard lock.
+	newer, older *limiterEntry
+	linked       bool  // limiter is in LRU list.
+	used         int64 // unix nanoseconds of wall clock when limiter was used, see limiterShard.touch. Accessed atomically.
+}
+
+// ruleLimiter is a limiter of matched rule.
+type ruleLimiter struct {
+	rule  *Rule
+	entry *limiterEntry
+	bytes bool // limiter counts bytes, not events.
+}
 
-	mu       sync.RWMutex
-	key      string
-	rules    []Rule
-	limiters map[string]*BucketLimiter
+// token is used to return tokens back if event is rejected by some of matched limiters.
+type token struct {
+	limiter Limiter
+	n       int64
 }
 
 // NewRemoteLimiter creates new remote limiter instance.
 func NewRemoteLimiter(url string, bucketInterval, buckets int64) (*RemoteLimiter, error) {
 	rl := &RemoteLimiter{
 		url:            url,
-		client:         http.DefaultClient,
+		client:         &http.Client{Timeout: policyRequestTimeout},
 		bucketInterval: bucketInterval,
 		buckets:        buckets,
-		limiters:       make(map[string]*BucketLimiter),
+		timestamp:      NewTimestampParser(DefaultTimestampField, nil),
+		limiters:       newLimiterMap(time.Duration(bucketInterval*buckets) * time.Second),
 	}
+	rl.config.Store(&limiterConfig{
+		futureTolerance: DefaultFutureTolerance,
+		latePolicy:      LateDrop,
+	})
 
 	return rl, nil
 }
 
+// Decision describes how event is treated by limiter.
+type Decision struct {
+	Allowed    bool
+	Rule       string    // name of rule that rejected event or the narrowest matched rule if event is allowed.
+	Key        string    // key of limiter that rejected event.
+	Timestamp  time.Time // event timestamp used by limiter.
+	SampleRate int64     // if event exceeded limit but passed as a sample, it's 1 of SampleRate events.
+	Throttled  bool      // event exceeded limit but is passed to be tagged.
+	DeadLetter bool      // rejected event must be written to dead-letter file.
+
+	Delay    time.Duration // if it's positive, event should be retried with Retry method during Delay.
+	Fallback bool          // delayed event exceeded maximum delay and fallback action is applied.
+
+	Late      bool // event timestamp is older than window tracked by limiters.
+	Duplicate bool // event is a repeat suppressed by Deduplicator, it doesn't take tokens.
+
+	Annotated   bool    // TRUE if rule requires to annotate allowed event with Utilization.
+	Utilization float64 // part of limit used after event is allowed.
+}
+
 // Allow returns TRUE if event is allowed to be processed.
 func (rl *RemoteLimiter) Allow(e *beat.Event) bool {
-	var ts time.Time
+	return rl.Decide(e).Allowed
+}
 
-	if tsString, err := e.GetValue("ts"); err == nil {
-		ts, _ = time.Parse(time.RFC3339, tsString.(string))
-	}
+// Decide applies limits to event.
+func (rl *RemoteLimiter) Decide(e *beat.Event) Decision {
+	return rl.DecideDedup(e, nil)
+}
 
-	if ts.IsZero() {
-		ts = time.Now()
-	}
+// DecideDedup is like Decide, but event is checked by dd before limits are applied, so duplicates
+// don't take tokens. Duplicates are tracked per limiter key of the narrowest matched rule.
+// If dd is nil, duplicates aren't checked.
+func (rl *RemoteLimiter) DecideDedup(e *beat.Event, dd *Deduplicator) Decision {
+	now := time.Now()
+	return rl.decide(e, rl.timestamp.Timestamp(e, now), now, false, dd)
+}
 
-	keyValue, _ := e.GetValue(rl.key)
-	kv := fmt.Sprintf("%v", keyValue)
+// SetLatePolicy sets policies for events with out-of-window timestamps.
+func (rl *RemoteLimiter) SetLatePolicy(policy string, futureTolerance time.Duration) error {
+	switch policy {
+	case "":
+		policy = LateDrop
+	case LateDrop, LateAllow, LateCurrent:
+	default:
+		return errors.Errorf("unknown late events policy: %q", policy)
+	}
+	if futureTolerance <= 0 {
+		futureTolerance = DefaultFutureTolerance
+	}
 
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	for _, r := range rl.rules {
-		if matched, key := r.Match(e); matched {
-			key = kv + key
-			// check if we already have limiter
-			limiter, ok := rl.limiters[key]
-			if !ok {
-				limiter = NewBucketLimiter(rl.bucketInterval, r.Limit(), rl.buckets, ts)
-				rl.limiters[key] = limiter
+	c := *rl.loadConfig()
+	c.latePolicy = policy
+	c.futureTolerance = futureTolerance
+	rl.config.Store(&c)
+
+	return nil
+}
+
+// loadConfig returns current policies.
+func (rl *RemoteLimiter) loadConfig() *limiterConfig {
+	return rl.config.Load().(*limiterConfig)
+}
+
+// SetMaxLimiters sets maximum number of limiters, 0 means no limit.
+// When limit is reached, idle limiters are evicted. If there are no idle limiters, new partitions of
+// rule share single overflow limiter.
+func (rl *RemoteLimiter) SetMaxLimiters(max int64) {
+	rl.limiters.setMax(max)
+}
+
+// LimiterStats contains information about limiters cardinality.
+type LimiterStats struct {
+	Limiters  int64 // current number of limiters.
+	Evictions int64 // number of limiters evicted to create new ones.
+	Overflows int64 // number of times overflow limiter is used because limiters cap is reached.
+	Reclaimed int64 // number of idle limiters removed by Prune.
+}
+
+// LimiterStats returns information about limiters cardinality.
+func (rl *RemoteLimiter) LimiterStats() LimiterStats {
+	return LimiterStats{
+		Limiters:  atomic.LoadInt64(&rl.limiters.size),
+		Evictions: atomic.LoadInt64(&rl.limiters.evictions),
+		Overflows: atomic.LoadInt64(&rl.overflows),
+		Reclaimed: atomic.LoadInt64(&rl.reclaimed),
+	}
+}
+
+// Stats returns number of events with out-of-window timestamps.
+func (rl *RemoteLimiter) Stats() TimestampStats {
+	return TimestampStats{
+		Future:      atomic.LoadInt64(&rl.stats.Future),
+		LateDropped: atomic.LoadInt64(&rl.stats.LateDropped),
+		LateAllowed: atomic.LoadInt64(&rl.stats.LateAllowed),
+		LateCurrent: atomic.LoadInt64(&rl.stats.LateCurrent),
+	}
+}
+
+// Retry applies limits to event delayed by OverflowDelay action. ts is event timestamp returned by the first decision
+// and waited is time event has been delayed for. Delayed event is counted at its timestamp shifted by waited,
+// because it waits for capacity of the next buckets. Event time is used instead of wall clock, so delayed events
+// of stream that lags behind don't shift buckets forward and don't make the following events late.
+// If final is TRUE, event can't be delayed anymore and fallback action is applied on overflow.
+func (rl *RemoteLimiter) Retry(e *beat.Event, ts time.Time, waited time.Duration, final bool) Decision {
+	return rl.decide(e, ts.Add(waited), time.Now(), final, nil)
+}
+
+func (rl *RemoteLimiter) decide(e *beat.Event, ts, now time.Time, final bool, dd *Deduplicator) Decision {
+	c := rl.loadConfig()
+	if c.rules == nil {
+		// policies are not loaded yet.
+		return Decision{Allowed: true}
+	}
+
+	var (
+		arr      [8]*Rule
+		tokens   [16]token
+		limiters [16]ruleLimiter
+		buf      [256]byte      // limiter keys are built in stack buffer, so lookups don't allocate.
+		size     int64     = -1 // event size is calculated only if it's required by some of rules.
+	)
+
+	kv, ok := c.key.Append(buf[:0], e)
+	if !ok {
+		return Decision{Allowed: true}
+	}
+
+	// for MatchAll strategy rules are ordered from the broadest to the narrowest one.
+	// Event takes tokens from all of them and tokens are returned back if any level rejects it.
+	var annotated *limiterEntry // limiter used to report utilization of allowed event.
+
+	matched := c.rules.Match(e, arr[:0])
+	d := Decision{Timestamp: ts}
+
+	if dd != nil {
+		// key shares buffer with kv, it's overwritten by limiter keys below.
+		r := matched[len(matched)-1]
+		if dd.Duplicate(append(kv, r.baseKey...), r.Name(), e, now) {
+			d.Duplicate = true
+			d.Rule = r.Name()
+			return d
+		}
+	}
+
+	if ts.After(now.Add(c.futureTolerance)) {
+		// event from the future would shift buckets forward and make all current events late.
+		atomic.AddInt64(&rl.stats.Future, 1)
+		ts = now
+		d.Timestamp = now
+	}
+
+	// limiters are looked up before limits are applied, so lateness is measured against their tracked windows.
+	var latest time.Time // the latest event of matched limiters.
+	ls := limiters[:0]
+	for _, r := range matched {
+		// key shares buffer with kv, previous rule keys are overwritten.
+		key := append(kv, r.baseKey...)
+
+		if r.limitsEvents() {
+			ls = append(ls, ruleLimiter{rule: r, entry: rl.entry(key, len(kv), r, false, ts, now)})
+		}
+		if r.LimitBytes() > 0 {
+			ls = append(ls, ruleLimiter{rule: r, entry: rl.entry(append(key, bytesKeySuffix), len(kv), r, true, ts, now), bytes: true})
+		}
+	}
+	for _, l := range ls {
+		if t := l.entry.LastUpdate(); t.After(latest) {
+			latest = t
+		}
+	}
+
+	window := time.Duration(rl.bucketInterval*rl.buckets) * time.Second
+	if !latest.IsZero() && ts.Before(latest.Add(-window)) {
+		d.Late = true
+		switch c.latePolicy {
+		case LateAllow:
+			atomic.AddInt64(&rl.stats.LateAllowed, 1)
+			d.Allowed = true
+			d.Rule = matched[len(matched)-1].Name()
+			return d
+		case LateCurrent:
+			atomic.AddInt64(&rl.stats.LateCurrent, 1)
+			ts = latest
+			d.Timestamp = latest
+		default:
+			atomic.AddInt64(&rl.stats.LateDropped, 1)
+			// late event can't be delayed until it fits into window, so fallback action is applied immediately.
+			l := ls[len(ls)-1]
+			d.Rule = l.rule.Name()
+			return rl.overflow(d, l.rule, l.entry, nil, ts, true)
+		}
+	}
+
+	taken := tokens[:0]
+	for _, l := range ls {
+		r := l.rule
+		d.Rule = r.Name()
+		share := r.classes.Share(e)
+
+		var cost int64
+		if l.bytes {
+			if size == -1 {
+				size = eventSize(e, c.sizeField)
 			}
+			cost = size
+		} else {
+			cost = r.cost.Of(e)
+		}
 
-			return limiter.Allow(ts)
+		if !allowShare(l.entry.Limiter, ts, cost, share) {
+			return rl.overflow(d, r, l.entry, taken, ts, final)
+		}
+		taken = append(taken, token{l.entry, cost})
+		// events limiter of the narrowest rule is preferred for annotation.
+		if r.annotate && (!l.bytes || annotated == nil) {
+			annotated = l.entry
 		}
 	}
 
-	return true
+	d.Allowed = true
+	if annotated != nil {
+		if u, ok := annotated.Limiter.(Utilizer); ok {
+			d.Annotated = true
+			d.Utilization = u.Utilization(ts)
+		}
+	}
+
+	return d
+}
+
+// entry returns limiter for key, new limiter is created if it doesn't exist.
+// kvLen is length of partition key prefix of key.
+// key isn't retained, so it can point to reusable buffer.
+func (rl *RemoteLimiter) entry(key []byte, kvLen int, r *Rule, bytes bool, ts, now time.Time) *limiterEntry {
+	create := func(key string) *limiterEntry {
+		l := &limiterEntry{key: key, rule: r.Name(), bytes: bytes}
+		if bytes {
+			l.Limiter = r.newBytesLimiter(rl.bucketInterval, rl.buckets, ts)
+		} else {
+			l.Limiter = r.newLimiter(rl.bucketInterval, rl.buckets, ts)
+		}
+		rl.restore(key, l.Limiter)
+
+		return l
+	}
+
+	if l := rl.limiters.getOrCreate(key, true, now, create); l != nil {
+		return l
+	}
+
+	// limiters cap is reached, so new partitions share overflow limiter of the rule.
+	atomic.AddInt64(&rl.overflows, 1)
+
+	var buf [256]byte
+	overflowKey := append(append(buf[:0], overflowKeyMarker), key[kvLen:]...)
+
+	return rl.limiters.getOrCreate(overflowKey, false, now, create)
+}
+
+// RunJanitor removes limiters that weren't used during ttl every interval until ctx is done.
+// Idle limiters are removed independently of policy updates.
+func (rl *RemoteLimiter) RunJanitor(ctx context.Context, interval, ttl time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-t.C:
+			if n := rl.Prune(now.Add(-ttl)); n > 0 {
+				logp.Debug("throttle", "removed %d idle limiters", n)
+			}
+		}
+	}
+}
+
+// Prune removes limiters that didn't get events since threshold of wall clock and returns number of removed limiters.
+func (rl *RemoteLimiter) Prune(threshold time.Time) int64 {
+	n := rl.limiters.prune(threshold)
+	atomic.AddInt64(&rl.reclaimed, n)
+	rl.pruneSnapshots(threshold)
+
+	return n
+}
+
+// overflow applies rule overflow action to event rejected by limiter l.
+func (rl *RemoteLimiter) overflow(d Decision, r *Rule, l *limiterEntry, taken []token, ts time.Time, final bool) Decision {
+	d.Key = l.key
+	// event that exceeded limit doesn't take tokens from other limiters even if it's passed.
+	rl.cancel(taken, ts)
+
+	action := r.overflowAction
+	if action == OverflowDelay {
+		if !final {
+			d.Delay = r.maxDelay
+			return d
+		}
+
+		action = r.delayFallback
+		d.Fallback = true
+	}
+
+	switch action {
+	case OverflowSample:
+		if (atomic.AddInt64(&l.overflow, 1)-1)%r.sampleRate == 0 {
+			d.Allowed = true
+			d.SampleRate = r.sampleRate
+		}
+	case OverflowTag:
+		d.Allowed = true
+		d.Throttled = true
+	}
+	d.DeadLetter = !d.Allowed && r.deadLetter
+
+	return d
+}
+
+// cancel returns taken tokens back.
+func (rl *RemoteLimiter) cancel(taken []token, ts time.Time) {
+	for _, t := range taken {
+		t.limiter.Cancel(ts, t.n)
+	}
 }
 
 // Update retrieves policies from Policy Manager.
@@ -92,6 +487,7 @@ func (rl *RemoteLimiter) Update(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to create request")
 	}
+	r = r.WithContext(ctx)
 
 	res, err := rl.client.Do(r)
 	if err != nil {
@@ -110,31 +506,91 @@ func (rl *RemoteLimiter) Update(ctx context.Context) error {
 		return errors.Wrap(err, "failed to unpack config")
 	}
 
-	rules := make([]Rule, 0, len(c.Rules)+1)
+	keys := c.Keys
+	if len(keys) == 0 && c.Key != "" {
+		keys = []string{c.Key}
+	}
+
+	key, err := NewPartitionKey(keys, c.MissingKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create partition key")
+	}
+
+	rules := make([]Rule, 0, len(c.Rules))
+	names := make(map[string]struct{}, len(c.Rules)+1)
+	// default rule name is reserved: limiters and metrics are looked up by rule name.
+	names[DefaultRuleName] = struct{}{}
 
 	for _, l := range c.Rules {
-		rules = append(rules, NewRule(l.Selectors, l.Limit))
+		if l.Name == DefaultRuleName {
+			return errors.Errorf("rule name %q is reserved", l.Name)
+		}
+		r, err := newRuleFromConfig(l)
+		if err != nil {
+			return errors.Wrapf(err, "invalid rule %q", l.Name)
+		}
+		if _, ok := names[r.Name()]; ok {
+			if l.Name != "" {
+				return errors.Errorf("duplicate rule name: %q", l.Name)
+			}
+			// names of rules with the same selectors can't be generated without depending on rules order.
+			return errors.Errorf("duplicate generated rule name %q: rules with the same selectors must have explicit names", r.Name())
+		}
+		names[r.Name()] = struct{}{}
+		rules = append(rules, r)
 	}
 
 	defaultRule := NewRule(map[string]string{}, c.DefaultLimit)
-	rules = append(rules, defaultRule)
+	defaultRule.limitBytes = c.DefaultBytes
+	defaultRule.setName(DefaultRuleName)
 
-	limiterTTL := time.Duration(rl.bucketInterval*rl.buckets) * time.Second
-	limiterThreshold := time.Now().Add(-limiterTTL)
+	sizeField := c.SizeField
+	if sizeField == "" {
+		sizeField = DefaultSizeField
+	}
+	index, err := NewRuleIndex(rules, defaultRule, c.MatchStrategy)
+	if err != nil {
+		return errors.Wrap(err, "failed to create rule index")
+	}
 
 	rl.mu.Lock()
-	defer rl.mu.Unlock()
-	rl.key = c.Key
-	rl.rules = rules
-	for id, l := range rl.limiters {
-		if l.LastUpdate().Before(limiterThreshold) {
-			delete(rl.limiters, id)
-		}
-	}
+	next := *rl.loadConfig()
+	next.key = key
+	next.sizeField = sizeField
+	next.rules = index
+	rl.config.Store(&next)
+	rl.mu.Unlock()
+
+	rl.migrate(index)
 
 	return nil
 }
 
+// migrate applies changed limits to existing limiters in place, so their buckets aren't reset.
+// Limiters of removed rules are kept until they become idle.
+func (rl *RemoteLimiter) migrate(index *RuleIndex) {
+	rules := make(map[string]*Rule, len(index.rules)+1)
+	for i := range index.rules {
+		rules[index.rules[i].Name()] = &index.rules[i]
+	}
+	rules[index.def.Name()] = &index.def
+
+	rl.limiters.rangeAll(func(l *limiterEntry) error {
+		r, ok := rules[l.rule]
+		if !ok {
+			return nil
+		}
+
+		limit := r.limit
+		if l.bytes {
+			limit = r.limitBytes
+		}
+		l.SetLimit(limit)
+
+		return nil
+	})
+}
+
 // UpdateWithInterval runs update with some interval.
 func (rl *RemoteLimiter) UpdateWithInterval(ctx context.Context, interval time.Duration) error {
 	t := time.NewTicker(interval)
@@ -153,18 +609,25 @@ func (rl *RemoteLimiter) UpdateWithInterval(ctx context.Context, interval time.D
 }
 
 func (rl *RemoteLimiter) WriteStatus(w io.Writer) error {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	for key, cl := range rl.limiters {
-		fmt.Fprintf(w, "#%v\n\n", key)
-		if err := cl.WriteStatus(w); err != nil {
+	err := rl.limiters.rangeAll(func(l *limiterEntry) error {
+		fmt.Fprintf(w, "#%v\n\n", l.key)
+		if err := l.WriteStatus(w); err != nil {
 			return err
 		}
 		fmt.Fprintln(w, "---------")
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	fmt.Fprintf(w, "rules: \n\n%#v", rl.rules)
+	if c := rl.loadConfig(); c.rules != nil {
+		fmt.Fprintf(w, "rules: \n\n")
+		for _, r := range c.rules.Rules() {
+			fmt.Fprintln(w, r)
+		}
+		fmt.Fprintln(w, c.rules.def)
+	}
 
 	return nil
 }
@@ -1,15 +1,22 @@
 package throttleplugin
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
 	"github.com/stretchr/testify/assert"
 )
 
-func testServer(t *testing.T, body []byte) (url string, closeFn func()) {
+func testServer(t testing.TB, body []byte) (url string, closeFn func()) {
 	h := func(w http.ResponseWriter, r *http.Request) {
 		w.Write(body)
 	}
@@ -18,6 +25,14 @@ func testServer(t *testing.T, body []byte) (url string, closeFn func()) {
 	return s.URL, func() { s.Close() }
 }
 
+// decide returns limiter decision without timestamp.
+func decide(l *RemoteLimiter, e *beat.Event) Decision {
+	d := l.Decide(e)
+	d.Timestamp = time.Time{}
+
+	return d
+}
+
 func TestRemoteLimiter_Update(t *testing.T) {
 	response := `key: id
 default_limit: 1
@@ -31,3 +46,781 @@ rules:
 	l, _ := NewRemoteLimiter(url, 1, 10)
 	assert.NoError(t, l.Update(context.Background()))
 }
+
+func TestRemoteLimiter_AllowKeys(t *testing.T) {
+	response := `keys: [ns, app]
+missing_key: skip
+default_limit: 1`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	newEvent := func(fields map[string]string) *beat.Event {
+		e := &beat.Event{Fields: common.MapStr{}}
+		for k, v := range fields {
+			e.PutValue(k, v)
+		}
+		return e
+	}
+
+	foo := newEvent(map[string]string{"ns": "a", "app": "foo"})
+	bar := newEvent(map[string]string{"ns": "a", "app": "bar"})
+	noApp := newEvent(map[string]string{"ns": "a"})
+
+	assert.True(t, l.Allow(foo))
+	assert.False(t, l.Allow(foo), "partition must be exceeded")
+	assert.True(t, l.Allow(bar), "partitions must be independent")
+	assert.True(t, l.Allow(noApp))
+	assert.True(t, l.Allow(noApp), "events without key must be skipped")
+}
+
+func TestRemoteLimiter_AllowHierarchical(t *testing.T) {
+	response := `match_strategy: all
+default_limit: 100
+rules:
+  - limit: 2
+    selectors:
+      ns: a
+      container: c1
+  - limit: 2
+    selectors:
+      ns: a
+      container: c2
+  - limit: 3
+    selectors:
+      ns: a`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	c1 := newTestEvent(map[string]interface{}{"ns": "a", "container": "c1"})
+	c2 := newTestEvent(map[string]interface{}{"ns": "a", "container": "c2"})
+
+	assert.True(t, l.Allow(c1))
+	assert.True(t, l.Allow(c1))
+	assert.False(t, l.Allow(c1), "container limit must be exceeded")
+	assert.True(t, l.Allow(c2), "namespace tokens must be returned after container rejection")
+	assert.False(t, l.Allow(c2), "namespace limit must be exceeded")
+}
+
+func TestRemoteLimiter_Decide(t *testing.T) {
+	response := `default_limit: 1
+rules:
+  - name: foo-rule
+    limit: 1
+    selectors:
+      app: foo`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	foo := newTestEvent(map[string]interface{}{"app": "foo"})
+	bar := newTestEvent(map[string]interface{}{"app": "bar"})
+
+	assert.Equal(t, Decision{Allowed: true, Rule: "foo-rule"}, decide(l, foo))
+	assert.Equal(t, Decision{Allowed: false, Rule: "foo-rule", Key: "foo-rule:foo:"}, decide(l, foo))
+	assert.Equal(t, Decision{Allowed: true, Rule: DefaultRuleName}, decide(l, bar))
+
+	var b bytes.Buffer
+	assert.NoError(t, l.WriteStatus(&b))
+	assert.Contains(t, b.String(), "foo-rule: limit=1 limit_bytes=0 priority=0 algorithm=bucket overflow=drop selectors=[app:foo]")
+}
+
+func TestRemoteLimiter_UpdateLimit(t *testing.T) {
+	policy := `default_limit: %d
+default_limit_bytes: %d
+rules:
+  - name: foo-rule
+    limit: %d
+    selectors:
+      app: foo`
+	url, closeFn := testServer(t, []byte(fmt.Sprintf(policy, 10, 100, 3)))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	foo := newTestEvent(map[string]interface{}{"app": "foo"})
+	bar := newTestEvent(map[string]interface{}{"app": "bar", "message": "0123456789"})
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow(foo))
+		assert.True(t, l.Allow(bar))
+	}
+
+	url, closeFn = testServer(t, []byte(fmt.Sprintf(policy, 10, 40, 4)))
+	defer closeFn()
+	l.url = url
+	assert.NoError(t, l.Update(context.Background()))
+
+	assert.True(t, l.Allow(foo), "increased limit must be applied")
+	assert.False(t, l.Allow(foo), "events counted before update must be kept")
+	assert.True(t, l.Allow(bar))
+	assert.False(t, l.Allow(bar), "bytes counted before update must be kept")
+	assert.EqualValues(t, 3, l.LimiterStats().Limiters, "limiters must be reused")
+}
+
+func TestRemoteLimiter_UpdateCancel(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer s.Close()
+	defer close(release)
+
+	l, _ := NewRemoteLimiter(s.URL, 60, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	assert.Error(t, l.Update(ctx))
+	assert.True(t, time.Since(start) < time.Second, "update must be cancelled with context")
+}
+
+func TestRemoteLimiter_UpdateDuplicateNames(t *testing.T) {
+	response := `rules:
+  - name: foo
+    limit: 1
+    selectors:
+      app: foo
+  - name: foo
+    limit: 1
+    selectors:
+      app: bar`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.Error(t, l.Update(context.Background()))
+}
+
+func TestRemoteLimiter_UpdateSameSelectors(t *testing.T) {
+	response := `rules:
+  - limit: 1
+    selectors:
+      app: foo
+  - limit: 2
+    algorithm: token_bucket
+    selectors:
+      app: foo`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.Error(t, l.Update(context.Background()), "rules with the same selectors must have explicit names")
+
+	response = `rules:
+  - name: foo-events
+    limit: 1
+    selectors:
+      app: foo
+  - name: foo-tokens
+    limit: 2
+    algorithm: token_bucket
+    selectors:
+      app: foo`
+	url, closeFn = testServer(t, []byte(response))
+	defer closeFn()
+
+	l.url = url
+	assert.NoError(t, l.Update(context.Background()))
+}
+
+func TestRemoteLimiter_UpdateReservedName(t *testing.T) {
+	response := `rules:
+  - name: default
+    limit: 1
+    selectors:
+      app: foo`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.Error(t, l.Update(context.Background()), "default rule name must be reserved")
+}
+
+func TestRemoteLimiter_AllowBytes(t *testing.T) {
+	response := `default_limit: 100
+rules:
+  - limit_bytes: 10
+    selectors:
+      app: bytes
+  - limit: 2
+    limit_bytes: 10
+    selectors:
+      app: both`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	t.Run("only bytes", func(t *testing.T) {
+		small := newTestEvent(map[string]interface{}{"app": "bytes", "message": "12345"})
+		large := newTestEvent(map[string]interface{}{"app": "bytes", "message": "1234567890a"})
+
+		assert.False(t, l.Allow(large), "event larger than limit must be rejected")
+		assert.True(t, l.Allow(small))
+		assert.True(t, l.Allow(small))
+		assert.False(t, l.Allow(small), "bytes limit must be exceeded")
+	})
+
+	t.Run("bytes and events", func(t *testing.T) {
+		large := newTestEvent(map[string]interface{}{"app": "both", "message": "1234567890a"})
+		small := newTestEvent(map[string]interface{}{"app": "both", "message": "1"})
+
+		assert.False(t, l.Allow(large))
+		assert.True(t, l.Allow(small), "event token must be returned after bytes rejection")
+		assert.True(t, l.Allow(small))
+		assert.False(t, l.Allow(small), "events limit must be exceeded")
+	})
+}
+
+func TestEventSize(t *testing.T) {
+	e := newTestEvent(map[string]interface{}{"message": "hello", "n": 12345})
+
+	assert.Equal(t, int64(5), eventSize(e, DefaultSizeField))
+	assert.Equal(t, int64(5), eventSize(e, "n"))
+	assert.Equal(t, int64(0), eventSize(e, "missing"))
+	assert.Equal(t, int64(len(`{"message":"hello","n":12345}`)), eventSize(e, EventSizeField))
+}
+
+func TestRemoteLimiter_AllowCost(t *testing.T) {
+	response := `default_limit: 2
+rules:
+  - limit: 2
+    cost:
+      field: level
+      values:
+        debug: 2
+        error: 0
+    selectors:
+      app: foo`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	debug := newTestEvent(map[string]interface{}{"app": "foo", "level": "debug"})
+	errorEvent := newTestEvent(map[string]interface{}{"app": "foo", "level": "error"})
+
+	assert.True(t, l.Allow(debug))
+	assert.False(t, l.Allow(debug), "debug events must exceed limit")
+	assert.True(t, l.Allow(errorEvent), "error events must be never dropped")
+}
+
+func TestRemoteLimiter_AllowSample(t *testing.T) {
+	response := `default_limit: 1
+rules:
+  - limit: 1
+    overflow_action: sample
+    sample_rate: 3
+    selectors:
+      app: foo`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	foo := newTestEvent(map[string]interface{}{"app": "foo"})
+
+	key := "app=foo:foo:"
+	assert.Equal(t, Decision{Allowed: true, Rule: "app=foo"}, decide(l, foo))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, Decision{Allowed: true, Rule: "app=foo", Key: key, SampleRate: 3}, decide(l, foo))
+		assert.Equal(t, Decision{Allowed: false, Rule: "app=foo", Key: key}, decide(l, foo))
+		assert.Equal(t, Decision{Allowed: false, Rule: "app=foo", Key: key}, decide(l, foo))
+	}
+}
+
+func TestRemoteLimiter_UpdateInvalidRule(t *testing.T) {
+	rules := []string{
+		"algorithm: foo",
+		"overflow_action: foo",
+		"{overflow_action: delay, delay_fallback: foo}",
+		"{overflow_action: delay, delay_fallback: delay}",
+	}
+	for _, rule := range rules {
+		t.Run(rule, func(t *testing.T) {
+			url, closeFn := testServer(t, []byte("rules:\n  - "+rule))
+			defer closeFn()
+
+			l, _ := NewRemoteLimiter(url, 60, 10)
+			assert.Error(t, l.Update(context.Background()))
+		})
+	}
+}
+
+func TestRemoteLimiter_DecideDeadLetter(t *testing.T) {
+	response := `default_limit: 0
+rules:
+  - limit: 0
+    dead_letter: true
+    selectors:
+      app: foo`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	assert.True(t, l.Decide(newTestEvent(map[string]interface{}{"app": "foo"})).DeadLetter)
+	assert.False(t, l.Decide(newTestEvent(map[string]interface{}{"app": "bar"})).DeadLetter)
+}
+
+func TestRemoteLimiter_Retry(t *testing.T) {
+	response := `default_limit: 1
+rules:
+  - limit: 1
+    overflow_action: delay
+    max_delay: 5s
+    delay_fallback: sample
+    sample_rate: 2
+    selectors:
+      app: foo`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 1, 1)
+	assert.NoError(t, l.Update(context.Background()))
+
+	now := time.Now()
+	foo := newTestEvent(map[string]interface{}{"app": "foo"})
+	key := "app=foo:foo:"
+
+	assert.True(t, l.Retry(foo, now, 0, false).Allowed)
+	assert.Equal(t, Decision{Rule: "app=foo", Key: key, Timestamp: now, Delay: 5 * time.Second}, l.Retry(foo, now, 0, false))
+	assert.Equal(t, Decision{Allowed: true, Rule: "app=foo", Key: key, Timestamp: now, SampleRate: 2, Fallback: true}, l.Retry(foo, now, 0, true))
+	assert.Equal(t, Decision{Rule: "app=foo", Key: key, Timestamp: now, Fallback: true}, l.Retry(foo, now, 0, true))
+
+	later := now.Add(time.Second)
+	assert.Equal(t, Decision{Allowed: true, Rule: "app=foo", Timestamp: later}, l.Retry(foo, now, time.Second, false), "event must pass in the next bucket")
+}
+
+func TestRemoteLimiter_RetryLaggingStream(t *testing.T) {
+	response := `default_limit: 1
+rules:
+  - limit: 1
+    overflow_action: delay
+    max_delay: 5s
+    selectors:
+      app: foo`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	ts := time.Now().Add(-time.Hour)
+	foo := &beat.Event{Timestamp: ts, Fields: common.MapStr{"app": "foo"}}
+	assert.True(t, l.Allow(foo))
+
+	d := l.Decide(foo)
+	assert.Equal(t, 5*time.Second, d.Delay)
+	assert.False(t, l.Retry(foo, d.Timestamp, 100*time.Millisecond, false).Allowed)
+
+	// retry must not shift buckets to wall clock, so the next events of the stream aren't late.
+	foo.Timestamp = ts.Add(time.Second)
+	d = l.Decide(foo)
+	assert.False(t, d.Late, "event must not be late after retry")
+	assert.Equal(t, 5*time.Second, d.Delay)
+	assert.True(t, l.Retry(foo, d.Timestamp, time.Minute, false).Allowed, "event must pass in the next bucket")
+}
+
+func TestRemoteLimiter_AllowClasses(t *testing.T) {
+	response := `default_limit: 1
+rules:
+  - limit: 4
+    classes:
+      field: level
+      shares:
+        debug: 0.25
+        info: 0.5
+    selectors:
+      app: foo`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	debug := newTestEvent(map[string]interface{}{"app": "foo", "level": "debug"})
+	info := newTestEvent(map[string]interface{}{"app": "foo", "level": "info"})
+	errorEvent := newTestEvent(map[string]interface{}{"app": "foo", "level": "error"})
+
+	assert.True(t, l.Allow(debug))
+	assert.False(t, l.Allow(debug), "debug events must be throttled first")
+	assert.True(t, l.Allow(info))
+	assert.False(t, l.Allow(info))
+	assert.True(t, l.Allow(errorEvent), "error events must use reserved headroom")
+	assert.True(t, l.Allow(errorEvent))
+	assert.False(t, l.Allow(errorEvent))
+}
+
+func TestRemoteLimiter_LatePolicy(t *testing.T) {
+	url, closeFn := testServer(t, []byte(`default_limit: 2`))
+	defer closeFn()
+
+	newEvent := func(ts time.Time) *beat.Event {
+		return &beat.Event{Timestamp: ts, Fields: common.MapStr{}}
+	}
+	late := time.Now().Add(-time.Hour)
+
+	cases := []struct {
+		policy  string
+		allowed bool
+		stats   TimestampStats
+	}{
+		{LateDrop, false, TimestampStats{LateDropped: 1}},
+		{LateAllow, true, TimestampStats{LateAllowed: 1}},
+		{LateCurrent, true, TimestampStats{LateCurrent: 1}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			l, _ := NewRemoteLimiter(url, 60, 10)
+			assert.NoError(t, l.SetLatePolicy(c.policy, 0))
+			assert.NoError(t, l.Update(context.Background()))
+			assert.True(t, l.Allow(newEvent(time.Now())))
+
+			d := l.Decide(newEvent(late))
+			assert.True(t, d.Late)
+			assert.Equal(t, c.allowed, d.Allowed)
+			assert.Equal(t, DefaultRuleName, d.Rule)
+			assert.Equal(t, c.stats, l.Stats())
+
+			// only events counted against the current bucket take tokens.
+			assert.Equal(t, c.policy != LateCurrent, l.Allow(newEvent(time.Now())))
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		l, _ := NewRemoteLimiter(url, 60, 10)
+		assert.Error(t, l.SetLatePolicy("foo", 0))
+	})
+}
+
+func TestRemoteLimiter_LateOverflowAction(t *testing.T) {
+	response := `keys: [app]
+default_limit: 10
+rules:
+  - limit: 10
+    overflow_action: tag
+    selectors:
+      app: tag
+  - limit: 10
+    dead_letter: true
+    selectors:
+      app: dlq
+  - limit: 10
+    overflow_action: delay
+    delay_fallback: tag
+    selectors:
+      app: delay`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	late := time.Now().Add(-time.Hour)
+	decide := func(app string, ts time.Time) Decision {
+		return l.Decide(&beat.Event{Timestamp: ts, Fields: common.MapStr{"app": app}})
+	}
+
+	assert.True(t, decide("tag", time.Now()).Allowed)
+	d := decide("tag", late)
+	assert.True(t, d.Late)
+	assert.True(t, d.Allowed, "late event must be tagged")
+	assert.True(t, d.Throttled)
+	assert.Equal(t, "app=tag", d.Rule)
+	assert.Equal(t, "3:tagapp=tag:tag:", d.Key)
+
+	assert.True(t, decide("dlq", time.Now()).Allowed)
+	d = decide("dlq", late)
+	assert.True(t, d.Late)
+	assert.False(t, d.Allowed)
+	assert.True(t, d.DeadLetter, "late event must be written to dead-letter file")
+	assert.Equal(t, "3:dlqapp=dlq:dlq:", d.Key)
+
+	assert.True(t, decide("delay", time.Now()).Allowed)
+	d = decide("delay", late)
+	assert.Equal(t, time.Duration(0), d.Delay, "late event must not be delayed")
+	assert.True(t, d.Fallback)
+	assert.True(t, d.Throttled)
+
+	assert.Equal(t, TimestampStats{LateDropped: 3}, l.Stats())
+}
+
+func TestRemoteLimiter_LaggingStream(t *testing.T) {
+	url, closeFn := testServer(t, []byte(`default_limit: 100`))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 1, 60)
+	assert.NoError(t, l.Update(context.Background()))
+
+	// stream replays backlog 10 minutes behind wall clock.
+	start := time.Now().Add(-10 * time.Minute)
+	for i := 0; i < 120; i++ {
+		ts := start.Add(time.Duration(i) * time.Second)
+		d := l.Decide(&beat.Event{Timestamp: ts, Fields: common.MapStr{}})
+		assert.True(t, d.Allowed, "event %d of lagging stream must be allowed", i)
+		assert.False(t, d.Late)
+	}
+
+	// event older than buckets tracked by limiter is late.
+	d := l.Decide(&beat.Event{Timestamp: start, Fields: common.MapStr{}})
+	assert.True(t, d.Late)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, TimestampStats{LateDropped: 1}, l.Stats())
+}
+
+func TestRemoteLimiter_FutureTimestamp(t *testing.T) {
+	url, closeFn := testServer(t, []byte(`default_limit: 2`))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.SetLatePolicy(LateDrop, time.Minute))
+	assert.NoError(t, l.Update(context.Background()))
+
+	future := &beat.Event{Timestamp: time.Now().Add(time.Hour), Fields: common.MapStr{}}
+	current := &beat.Event{Timestamp: time.Now(), Fields: common.MapStr{}}
+
+	assert.True(t, l.Allow(future))
+	assert.True(t, l.Allow(current), "future event must not shift buckets")
+	assert.False(t, l.Allow(current), "future event must be counted against the current bucket")
+	assert.Equal(t, TimestampStats{Future: 1}, l.Stats())
+}
+
+func BenchmarkRemoteLimiter_DecideParallel(b *testing.B) {
+	response := `keys: [app]
+default_limit: 1000000000
+rules:
+  - limit: 1000000000
+    selectors:
+      ns: a`
+	url, closeFn := testServer(b, []byte(response))
+	defer closeFn()
+
+	for _, keys := range []int{1, 1000} {
+		b.Run(fmt.Sprintf("keys=%d", keys), func(b *testing.B) {
+			l, _ := NewRemoteLimiter(url, 60, 10)
+			if err := l.Update(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+
+			events := make([]*beat.Event, keys)
+			for i := range events {
+				events[i] = newTestEvent(map[string]interface{}{"ns": "a", "app": fmt.Sprintf("app-%d", i)})
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					l.Decide(events[i%keys])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestRemoteLimiter_DecideDedup(t *testing.T) {
+	url, closeFn := testServer(t, []byte("keys: [app]\ndefault_limit: 2"))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+	dd := NewDeduplicator(DedupConfig{})
+
+	foo := newTestEvent(map[string]interface{}{"app": "foo", "message": "foo"})
+	bar := newTestEvent(map[string]interface{}{"app": "foo", "message": "bar"})
+	assert.True(t, l.DecideDedup(foo, dd).Allowed)
+	d := l.DecideDedup(foo, dd)
+	assert.True(t, d.Duplicate)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, DefaultRuleName, d.Rule)
+	assert.True(t, l.DecideDedup(bar, dd).Allowed, "duplicates must not take tokens")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		l.DecideDedup(foo, dd)
+	})
+	assert.Equal(t, float64(0), allocs, "duplicates must be checked without allocations")
+}
+
+func TestRemoteLimiter_DecideConcurrent(t *testing.T) {
+	url, closeFn := testServer(t, []byte(`default_limit: 1000`))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	var (
+		wg      sync.WaitGroup
+		allowed int64
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if l.Allow(newTestEvent(nil)) {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+	// policies are updated concurrently with processing.
+	assert.NoError(t, l.Update(context.Background()))
+	wg.Wait()
+
+	assert.Equal(t, int64(1000), allowed, "limit must be enforced exactly under concurrency")
+}
+
+// TestRemoteLimiter_KeysStress checks that limiter keys aren't corrupted when events are processed concurrently.
+// It's intended to be run with race detector.
+func TestRemoteLimiter_KeysStress(t *testing.T) {
+	response := `keys: [app]
+match_strategy: all
+default_limit: 1000000
+rules:
+  - limit: 1000000
+    limit_bytes: 1000000000
+    selectors:
+      ns: a
+  - limit: 1000000
+    selectors:
+      ns: a
+      container: c`
+	url, closeFn := testServer(t, []byte(response))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	const (
+		goroutines = 8
+		apps       = 50
+		events     = 500
+	)
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < events; i++ {
+				app := fmt.Sprintf("app-%d", (g*events+i)%apps)
+				e := newTestEvent(map[string]interface{}{"ns": "a", "container": "c", "app": app, "message": "hello"})
+				if d := l.Decide(e); !assert.True(t, d.Allowed) {
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	keys := make(map[string]bool)
+	l.limiters.rangeAll(func(e *limiterEntry) error {
+		keys[e.key] = true
+		return nil
+	})
+	// every app has events and bytes limiters of namespace rule and events limiter of container rule.
+	assert.Equal(t, apps*3, len(keys))
+	for i := 0; i < apps; i++ {
+		kv := appendKeyValue(nil, fmt.Sprintf("app-%d", i))
+		assert.True(t, keys[string(kv)+"ns=a:a:"], "events limiter of app-%d", i)
+		assert.True(t, keys[string(kv)+"ns=a:a:b"], "bytes limiter of app-%d", i)
+		assert.True(t, keys[string(kv)+"container=c,ns=a:c:a:"], "container limiter of app-%d", i)
+	}
+}
+
+func TestRemoteLimiter_MaxLimiters(t *testing.T) {
+	url, closeFn := testServer(t, []byte("keys: [app]\ndefault_limit: 1"))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	l.SetMaxLimiters(limiterShards)
+	assert.NoError(t, l.Update(context.Background()))
+
+	rejected := 0
+	for i := 0; i < 500; i++ {
+		d := l.Decide(newTestEvent(map[string]interface{}{"app": fmt.Sprintf("app-%d", i)}))
+		if !d.Allowed {
+			rejected++
+			// new partitions share overflow limiter when cap is reached.
+			assert.Equal(t, "~default:", d.Key)
+		}
+	}
+
+	stats := l.LimiterStats()
+	assert.Equal(t, 500-limiterShards-1, rejected, "first event of overflow limiter is allowed")
+	assert.Equal(t, int64(limiterShards+1), stats.Limiters, "limiters must be capped with overflow limiter")
+	assert.Equal(t, int64(rejected+1), stats.Overflows)
+	assert.Equal(t, int64(0), stats.Evictions, "active limiters must not be evicted")
+
+	assert.Equal(t, int64(0), l.Prune(time.Now().Add(-time.Minute)), "active limiters must not be pruned")
+	assert.Equal(t, stats.Limiters, l.Prune(time.Now().Add(time.Hour)))
+	assert.Equal(t, int64(0), l.LimiterStats().Limiters)
+	assert.Equal(t, stats.Limiters, l.LimiterStats().Reclaimed)
+}
+
+func TestRemoteLimiter_RunJanitor(t *testing.T) {
+	url, closeFn := testServer(t, []byte("keys: [app]\ndefault_limit: 10"))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	// limiters idleness is measured by wall clock, so limiter of stream that lags behind is kept.
+	lagging := &beat.Event{Timestamp: time.Now().Add(-time.Hour), Fields: common.MapStr{"app": "lagging"}}
+	idle := &beat.Event{Timestamp: time.Now().Add(-time.Minute), Fields: common.MapStr{"app": "idle"}}
+	assert.True(t, l.Allow(lagging))
+	assert.True(t, l.decide(idle, idle.Timestamp, idle.Timestamp, false, nil).Allowed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- l.RunJanitor(ctx, 10*time.Millisecond, 30*time.Second)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for l.LimiterStats().Reclaimed == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, LimiterStats{Limiters: 1, Reclaimed: 1}, l.LimiterStats())
+}
+
+func TestRemoteLimiter_PruneLaggingStream(t *testing.T) {
+	url, closeFn := testServer(t, []byte("keys: [app]\ndefault_limit: 2"))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, 60, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	now := time.Now()
+	e := &beat.Event{Timestamp: now.Add(-time.Hour), Fields: common.MapStr{"app": "foo"}}
+	assert.True(t, l.Allow(e))
+	assert.True(t, l.Allow(e))
+	assert.False(t, l.Allow(e))
+
+	assert.Equal(t, int64(0), l.Prune(now.Add(-5*time.Minute)), "used limiter must not be pruned")
+	e.Timestamp = e.Timestamp.Add(time.Second)
+	assert.False(t, l.Allow(e), "buckets must not be reset")
+}
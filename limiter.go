@@ -0,0 +1,174 @@
+package throttleplugin
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Built-in limiting algorithms.
+const (
+	// AlgorithmBucket is a set of fixed windows (buckets) chosen by event timestamp.
+	AlgorithmBucket = "bucket"
+	// AlgorithmTokenBucket is a token bucket with rate and burst implemented as GCRA.
+	AlgorithmTokenBucket = "token_bucket"
+	// AlgorithmSlidingWindow is a sliding window counter.
+	AlgorithmSlidingWindow = "sliding_window"
+)
+
+// Limiter is implemented by all limiting algorithms.
+// All methods must be safe for concurrent use.
+type Limiter interface {
+	// Allow returns TRUE if event with time t and specified cost is allowed to be processed.
+	Allow(t time.Time, cost int64) bool
+	// Cancel returns tokens taken by previous Allow call for the same time.
+	Cancel(t time.Time, cost int64)
+	// SetLimit updates limit value.
+	SetLimit(limit int64)
+	// LastUpdate returns time of the latest event passed to Allow. It's used to remove idle limiters.
+	LastUpdate() time.Time
+	// WriteStatus writes text based status into Writer.
+	WriteStatus(w io.Writer) error
+	// Snapshot returns serializable limiter state.
+	Snapshot() Snapshot
+}
+
+// Utilizer is optionally implemented by limiters that can report their utilization.
+type Utilizer interface {
+	// Utilization returns part of limit used at time t (1 means that limit is reached).
+	Utilization(t time.Time) float64
+}
+
+// ShareLimiter is optionally implemented by limiters that support priority classes (see ClassConfig).
+type ShareLimiter interface {
+	// AllowShare is like Allow, but event is allowed only if limiter has capacity in the share part of limit.
+	AllowShare(t time.Time, cost int64, share float64) bool
+}
+
+// Restorer is optionally implemented by limiters that can continue from snapshot after restart (see StateConfig).
+type Restorer interface {
+	// Restore loads state from snapshot of the same algorithm into new limiter.
+	// State of windows that aren't tracked by limiter is discarded.
+	Restore(s Snapshot) error
+}
+
+// allowShare applies limiter to event of class with specified share.
+// Limiters that don't support classes apply the whole limit to all events.
+func allowShare(l Limiter, t time.Time, cost int64, share float64) bool {
+	if share < 1 {
+		if sl, ok := l.(ShareLimiter); ok {
+			return sl.AllowShare(t, cost, share)
+		}
+	}
+
+	return l.Allow(t, cost)
+}
+
+// Snapshot is a serializable state of limiter.
+type Snapshot struct {
+	Algorithm  string          `json:"algorithm"`
+	Limit      int64           `json:"limit"`
+	LastUpdate time.Time       `json:"last_update"`
+	State      json.RawMessage `json:"state"` // algorithm specific state.
+}
+
+// newSnapshot returns snapshot with state marshaled to JSON.
+func newSnapshot(algorithm string, limit int64, lastUpdate time.Time, state interface{}) Snapshot {
+	// state structs of built-in algorithms are always serializable.
+	b, _ := json.Marshal(state)
+
+	return Snapshot{
+		Algorithm:  algorithm,
+		Limit:      limit,
+		LastUpdate: lastUpdate,
+		State:      b,
+	}
+}
+
+// unmarshalState checks snapshot algorithm and unmarshals algorithm specific state into v.
+func unmarshalState(s Snapshot, algorithm string, v interface{}) error {
+	if s.Algorithm != algorithm {
+		return errors.Errorf("snapshot of %q algorithm can't be restored by %q limiter", s.Algorithm, algorithm)
+	}
+
+	return errors.Wrap(json.Unmarshal(s.State, v), "failed to unmarshal limiter state")
+}
+
+// LimiterParams contains parameters of limiter.
+type LimiterParams struct {
+	BucketInterval int64                  // bucket (window) interval in seconds.
+	Buckets        int64                  // number of tracked buckets.
+	Limit          int64                  // maximum number of tokens per bucket interval.
+	Burst          int64                  // maximum burst, 0 means the same as Limit.
+	Options        map[string]interface{} // algorithm specific options from rule config.
+}
+
+// LimiterFactory creates new limiter instance. now is the timestamp of the first event.
+type LimiterFactory func(p LimiterParams, now time.Time) Limiter
+
+var (
+	algorithmsMu sync.RWMutex
+	algorithms   = make(map[string]LimiterFactory)
+)
+
+func init() {
+	RegisterAlgorithm(AlgorithmBucket, newBucketLimiter)
+	RegisterAlgorithm(AlgorithmTokenBucket, func(p LimiterParams, now time.Time) Limiter {
+		return NewTokenBucketLimiter(p.BucketInterval, p.Limit, p.Burst, now)
+	})
+	RegisterAlgorithm(AlgorithmSlidingWindow, func(p LimiterParams, now time.Time) Limiter {
+		return NewSlidingWindowLimiter(p.BucketInterval, p.Limit, now)
+	})
+}
+
+// newBucketLimiter is the factory of default algorithm.
+func newBucketLimiter(p LimiterParams, now time.Time) Limiter {
+	return NewBucketLimiter(p.BucketInterval, p.Limit, p.Buckets, now)
+}
+
+// RegisterAlgorithm makes limiting algorithm available by name in rules config.
+// It's intended to be called from init functions of packages compiled in beat binary.
+// If RegisterAlgorithm is called twice with the same name, it panics.
+func RegisterAlgorithm(name string, f LimiterFactory) {
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+
+	if f == nil {
+		panic("throttle: limiter factory is nil for algorithm " + name)
+	}
+	if _, ok := algorithms[name]; ok {
+		panic("throttle: algorithm is already registered: " + name)
+	}
+	algorithms[name] = f
+}
+
+// Algorithms returns sorted list of registered algorithms.
+func Algorithms() []string {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// lookupAlgorithm returns limiter factory for algorithm.
+func lookupAlgorithm(name string) (LimiterFactory, error) {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+
+	f, ok := algorithms[name]
+	if !ok {
+		return nil, errors.Errorf("unknown algorithm: %q", name)
+	}
+
+	return f, nil
+}
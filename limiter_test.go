@@ -0,0 +1,288 @@
+package throttleplugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketLimiter_Cancel(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	bl := NewBucketLimiter(60, 1, 5, now)
+
+	assert.True(t, bl.Allow(now, 1))
+	assert.False(t, bl.Allow(now, 1))
+
+	bl.Cancel(now, 1)
+	assert.True(t, bl.Allow(now, 1), "token must be returned")
+
+	// cancel of not tracked bucket must be ignored.
+	bl.Cancel(now.Add(-time.Hour), 1)
+	bl.Cancel(now.Add(time.Hour), 1)
+}
+
+func TestBucketLimiter_AllowCost(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	bl := NewBucketLimiter(60, 5, 5, now)
+
+	assert.True(t, bl.Allow(now, 3))
+	assert.False(t, bl.Allow(now, 3), "bucket must be exceeded")
+	assert.True(t, bl.Allow(now, 2))
+	assert.True(t, bl.Allow(now, 0), "zero cost event must be allowed")
+}
+
+func TestTokenBucketLimiter_Allow(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+
+	t.Run("burst", func(t *testing.T) {
+		tb := NewTokenBucketLimiter(1, 10, 3, now)
+
+		assert.True(t, tb.Allow(now, 1))
+		assert.True(t, tb.Allow(now, 1))
+		assert.True(t, tb.Allow(now, 1))
+		assert.False(t, tb.Allow(now, 1), "burst must be exceeded")
+	})
+
+	t.Run("refill", func(t *testing.T) {
+		tb := NewTokenBucketLimiter(1, 10, 1, now)
+
+		assert.True(t, tb.Allow(now, 1))
+		assert.False(t, tb.Allow(now.Add(50*time.Millisecond), 1))
+		assert.True(t, tb.Allow(now.Add(100*time.Millisecond), 1), "one token must be refilled")
+	})
+
+	t.Run("no double limit at window boundary", func(t *testing.T) {
+		tb := NewTokenBucketLimiter(1, 10, 0, now)
+		end := now.Truncate(time.Second).Add(time.Second - time.Millisecond)
+
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			if tb.Allow(end, 1) {
+				allowed++
+			}
+		}
+		for i := 0; i < 20; i++ {
+			if tb.Allow(end.Add(2*time.Millisecond), 1) {
+				allowed++
+			}
+		}
+
+		assert.Equal(t, 10, allowed)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		tb := NewTokenBucketLimiter(1, 10, 1, now)
+
+		assert.True(t, tb.Allow(now, 1))
+		tb.Cancel(now, 1)
+		assert.True(t, tb.Allow(now, 1))
+	})
+
+	t.Run("zero limit", func(t *testing.T) {
+		tb := NewTokenBucketLimiter(1, 0, 0, now)
+
+		assert.False(t, tb.Allow(now, 1))
+		assert.True(t, tb.Allow(now, 0))
+	})
+}
+
+func TestSlidingWindowLimiter_Allow(t *testing.T) {
+	start := time.Date(2018, 12, 19, 19, 30, 0, 0, time.UTC)
+
+	t.Run("current window", func(t *testing.T) {
+		sw := NewSlidingWindowLimiter(60, 2, start)
+
+		assert.True(t, sw.Allow(start, 1))
+		assert.True(t, sw.Allow(start, 1))
+		assert.False(t, sw.Allow(start, 1))
+	})
+
+	t.Run("previous window is weighted", func(t *testing.T) {
+		sw := NewSlidingWindowLimiter(60, 10, start)
+		for i := 0; i < 10; i++ {
+			assert.True(t, sw.Allow(start.Add(59*time.Second), 1))
+		}
+
+		// at the beginning of next window the previous one still counts almost completely.
+		assert.False(t, sw.Allow(start.Add(61*time.Second), 1))
+		// in the middle of next window only half of previous one counts.
+		for i := 0; i < 5; i++ {
+			assert.True(t, sw.Allow(start.Add(90*time.Second), 1))
+		}
+		assert.False(t, sw.Allow(start.Add(90*time.Second), 1))
+	})
+
+	t.Run("skipped window", func(t *testing.T) {
+		sw := NewSlidingWindowLimiter(60, 1, start)
+
+		assert.True(t, sw.Allow(start, 1))
+		assert.True(t, sw.Allow(start.Add(2*time.Minute), 1))
+	})
+}
+
+// constLimiter is a custom algorithm used to test algorithms registry.
+type constLimiter struct {
+	*BucketLimiter
+	allow bool
+}
+
+func (cl constLimiter) Allow(t time.Time, cost int64) bool {
+	return cl.allow
+}
+
+func TestRegisterAlgorithm(t *testing.T) {
+	RegisterAlgorithm("test_deny_all", func(p LimiterParams, now time.Time) Limiter {
+		return constLimiter{BucketLimiter: NewBucketLimiter(p.BucketInterval, p.Limit, p.Buckets, now), allow: p.Options["allow"] == true}
+	})
+
+	assert.Contains(t, Algorithms(), AlgorithmBucket)
+	assert.Contains(t, Algorithms(), AlgorithmTokenBucket)
+	assert.Contains(t, Algorithms(), AlgorithmSlidingWindow)
+	assert.Contains(t, Algorithms(), "test_deny_all")
+
+	assert.Panics(t, func() {
+		RegisterAlgorithm(AlgorithmBucket, newBucketLimiter)
+	}, "duplicate registration must panic")
+
+	_, err := lookupAlgorithm("foo")
+	assert.Error(t, err)
+
+	r, err := newRuleFromConfig(RuleConfig{Limit: 100, Algorithm: "test_deny_all"})
+	assert.NoError(t, err)
+	assert.False(t, r.newLimiter(1, 1, time.Now()).Allow(time.Now(), 1))
+
+	r, err = newRuleFromConfig(RuleConfig{Limit: 100, Algorithm: "test_deny_all", AlgorithmOptions: map[string]interface{}{"allow": true}})
+	assert.NoError(t, err)
+	assert.True(t, r.newLimiter(1, 1, time.Now()).Allow(time.Now(), 1))
+}
+
+func TestLimiter_Snapshot(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+
+	bl := NewBucketLimiter(60, 10, 2, now)
+	bl.Allow(now, 3)
+	s := bl.Snapshot()
+	assert.Equal(t, AlgorithmBucket, s.Algorithm)
+	assert.Equal(t, int64(10), s.Limit)
+	assert.JSONEq(t, `{"min_bucket_id": 25754129, "buckets": [0, 3]}`, string(s.State))
+
+	tb := NewTokenBucketLimiter(1, 10, 0, now)
+	tb.Allow(now, 1)
+	assert.JSONEq(t, `{"tat": "2018-12-19T19:30:25.1Z"}`, string(tb.Snapshot().State))
+
+	sw := NewSlidingWindowLimiter(60, 10, now)
+	sw.Allow(now, 2)
+	assert.JSONEq(t, `{"window_id": 25754130, "current": 2, "previous": 0}`, string(sw.Snapshot().State))
+}
+
+func TestLimiter_Utilization(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 0, 0, time.UTC)
+
+	limiters := map[string]Limiter{
+		AlgorithmBucket:        NewBucketLimiter(60, 4, 2, now),
+		AlgorithmTokenBucket:   NewTokenBucketLimiter(60, 4, 0, now),
+		AlgorithmSlidingWindow: NewSlidingWindowLimiter(60, 4, now),
+	}
+
+	for name, l := range limiters {
+		t.Run(name, func(t *testing.T) {
+			u, ok := l.(Utilizer)
+			if !assert.True(t, ok) {
+				return
+			}
+
+			assert.Equal(t, 0.0, u.Utilization(now))
+			l.Allow(now, 1)
+			assert.Equal(t, 0.25, u.Utilization(now))
+			l.Allow(now, 3)
+			assert.Equal(t, 1.0, u.Utilization(now))
+		})
+	}
+}
+
+func TestLimiter_AllowShare(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	limiters := map[string]ShareLimiter{
+		AlgorithmBucket:        NewBucketLimiter(60, 4, 1, now),
+		AlgorithmTokenBucket:   NewTokenBucketLimiter(60, 4, 0, now),
+		AlgorithmSlidingWindow: NewSlidingWindowLimiter(60, 4, now),
+	}
+
+	for name, l := range limiters {
+		t.Run(name, func(t *testing.T) {
+			assert.True(t, l.AllowShare(now, 1, 0.5))
+			assert.True(t, l.AllowShare(now, 1, 0.5))
+			assert.False(t, l.AllowShare(now, 1, 0.5), "low class share must be exceeded")
+			assert.True(t, l.AllowShare(now, 1, 1), "high class must use reserved headroom")
+			assert.True(t, l.AllowShare(now, 1, 1))
+			assert.False(t, l.AllowShare(now, 1, 1), "limit must be exceeded")
+		})
+	}
+}
+
+func BenchmarkBucketLimiter_AllowParallel(b *testing.B) {
+	now := time.Now()
+	bl := NewBucketLimiter(60, 1<<62, 10, now)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			bl.Allow(now, 1)
+		}
+	})
+}
+
+func TestLimiter_LastUpdate(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	limiters := map[string]Limiter{
+		AlgorithmBucket:        NewBucketLimiter(60, 10, 10, now),
+		AlgorithmTokenBucket:   NewTokenBucketLimiter(60, 10, 0, now),
+		AlgorithmSlidingWindow: NewSlidingWindowLimiter(60, 10, now),
+	}
+
+	for name, l := range limiters {
+		t.Run(name, func(t *testing.T) {
+			assert.True(t, l.LastUpdate().IsZero())
+
+			l.Allow(now, 1)
+			assert.True(t, now.Equal(l.LastUpdate()), "event time must be used")
+
+			l.Allow(now.Add(-time.Minute), 1)
+			assert.True(t, now.Equal(l.LastUpdate()), "late event must not move last update back")
+		})
+	}
+}
+
+func TestLimiter_Restore(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	later := now.Add(time.Minute)
+
+	bl := NewBucketLimiter(60, 10, 2, now)
+	bl.Allow(now, 3)
+	restored := NewBucketLimiter(60, 10, 2, later)
+	assert.NoError(t, restored.Restore(bl.Snapshot()))
+	assert.JSONEq(t, `{"min_bucket_id": 25754130, "buckets": [3, 0]}`, string(restored.Snapshot().State))
+	assert.True(t, now.Equal(restored.LastUpdate()))
+
+	restored = NewBucketLimiter(60, 10, 2, now.Add(-time.Minute))
+	assert.NoError(t, restored.Restore(bl.Snapshot()))
+	assert.False(t, restored.Allow(now, 8), "buckets must be shifted to the latest restored one")
+
+	expired := NewBucketLimiter(60, 10, 2, now.Add(2*time.Minute))
+	assert.NoError(t, expired.Restore(bl.Snapshot()))
+	assert.JSONEq(t, `{"min_bucket_id": 25754131, "buckets": [0, 0]}`, string(expired.Snapshot().State))
+
+	tb := NewTokenBucketLimiter(1, 10, 0, now)
+	tb.Allow(now, 10)
+	restoredTB := NewTokenBucketLimiter(1, 10, 0, now)
+	assert.NoError(t, restoredTB.Restore(tb.Snapshot()))
+	assert.False(t, restoredTB.Allow(now, 1))
+
+	sw := NewSlidingWindowLimiter(60, 10, now)
+	sw.Allow(now, 2)
+	restoredSW := NewSlidingWindowLimiter(60, 10, later)
+	assert.NoError(t, restoredSW.Restore(sw.Snapshot()))
+	assert.JSONEq(t, `{"window_id": 25754131, "current": 0, "previous": 2}`, string(restoredSW.Snapshot().State))
+
+	assert.Error(t, restoredSW.Restore(bl.Snapshot()), "snapshot of another algorithm must be rejected")
+}
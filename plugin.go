@@ -6,6 +6,7 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/elastic/beats/libbeat/beat"
@@ -19,17 +20,59 @@ import (
 
 var unknownValue = "UNKNOWN"
 
+const (
+	// delayPollInterval is interval between attempts to pass event delayed by OverflowDelay action.
+	delayPollInterval = 50 * time.Millisecond
+	// metricResetInterval is interval of resetting events counter, so label values of stopped inputs are removed.
+	metricResetInterval = time.Minute
+	// shutdownTimeout is maximum time to wait for active HTTP requests on Close.
+	shutdownTimeout = 5 * time.Second
+)
+
+// Fields added to events by processor.
+const (
+	// SampleRateField is added to events passed as samples after limit is exceeded.
+	// Its value N means that the event represents N events, so downstream can extrapolate counts.
+	SampleRateField = "throttle.sample_rate"
+
+	// ThrottledField, RuleField and KeyField are added to events exceeded limit of rule with "tag" overflow action.
+	ThrottledField = "throttle.throttled"
+	RuleField      = "throttle.rule"
+	KeyField       = "throttle.key"
+
+	// UtilizationField is added to allowed events if rule requires annotation.
+	UtilizationField = "throttle.utilization"
+)
+
 // Config defines processor configuration.
 type Config struct {
 	PolicyHost           string        `config:"policy_host"`
 	PolicyUpdateInterval time.Duration `config:"policy_update_interval"`
 	PrometheusPort       int           `config:"prometheus_port"`
 
-	BucketSize int64 `config:"bucket_size"`
-	Buckets    int64 `config:"buckets"`
+	BucketSize  int64 `config:"bucket_size"`
+	Buckets     int64 `config:"buckets"`
+	MaxLimiters int64 `config:"max_limiters"`
+
+	JanitorInterval time.Duration `config:"janitor_interval"`
+	LimiterTTL      time.Duration `config:"limiter_ttl"`
+
+	TimestampField   string   `config:"timestamp_field"`
+	TimestampFormats []string `config:"timestamp_formats"`
+
+	FutureTolerance time.Duration `config:"future_tolerance"`
+	LateEvents      string        `config:"late_events"`
 
 	MetricName   string         `config:"metric_name"`
 	MetricLabels []LabelMapping `config:"metric_labels"`
+
+	SummaryInterval time.Duration `config:"summary_interval"`
+
+	DeadLetter *DeadLetterConfig `config:"dead_letter"`
+
+	Dedup *DedupConfig `config:"dedup"`
+
+	State *StateConfig `config:"state"`
 }
 
 type LabelMapping struct {
@@ -66,8 +109,20 @@ type Processor struct {
 
 	limiter   *RemoteLimiter
 	throttled int64
+	summary   *SummaryTracker // nil if summary events are disabled.
+	dlq       *DeadLetterSink // nil if dead-letter file is disabled.
+	dedup     *Deduplicator   // nil if duplicates are not suppressed.
+
+	delayWait      prometheus.Histogram // time spent by delayed events waiting for capacity.
+	delayFallbacks prometheus.Counter   // number of delayed events passed to fallback action.
 
-	httpServer *http.Server
+	registry       *prometheus.Registry // processor metrics, so multiple processors can be created in one process.
+	metricsHandler http.Handler         // serves registry, see serveMetrics.
+	metricsPort    int
+	serving        bool // processor is registered in metrics server.
+
+	stop context.CancelFunc // stops background goroutines.
+	wg   sync.WaitGroup     // background goroutines, Close waits for them.
 }
 
 // NewProcessor returns new processor instance.
@@ -87,76 +142,312 @@ func newProcessor(cfg *common.Config) (*Processor, error) {
 			Name:      c.MetricName,
 			Help:      c.MetricName,
 		},
-		append(c.GetMetricLabels(), "throttled"),
+		append(c.GetMetricLabels(), "rule", "throttled"),
 	)
 
-	go func() {
-		t := time.NewTicker(time.Minute)
-		defer t.Stop()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		vec,
+	)
 
-		for range t.C {
-			vec.Reset()
-		}
-	}()
-	prometheus.MustRegister(vec)
+	delayWait := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "filebeat",
+		Name:      c.MetricName + "_delay_seconds",
+		Help:      "time spent by delayed events waiting for limiter capacity",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	})
+	delayFallbacks := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "filebeat",
+		Name:      c.MetricName + "_delay_fallbacks",
+		Help:      "number of delayed events that exceeded maximum delay",
+	})
+	registry.MustRegister(delayWait, delayFallbacks)
 
 	limiter, err := NewRemoteLimiter(c.PolicyHost, c.BucketSize, c.Buckets)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create RemoteLimiter")
 	}
+	limiter.timestamp = NewTimestampParser(c.TimestampField, c.TimestampFormats)
+	if err := limiter.SetLatePolicy(c.LateEvents, c.FutureTolerance); err != nil {
+		return nil, err
+	}
+	limiter.SetMaxLimiters(c.MaxLimiters)
+
+	if c.State != nil && c.State.Path != "" {
+		n, err := limiter.LoadStateFile(c.State.Path, time.Now())
+		if err != nil {
+			logp.Err("failed to load throttle state: %v", err)
+		} else {
+			logp.Info("loaded %d limiters from throttle state %s", n, c.State.Path)
+		}
+	}
+
+	counterFunc := func(name, help string, f func() int64) prometheus.CounterFunc {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "filebeat",
+			Name:      c.MetricName + name,
+			Help:      help,
+		}, func() float64 {
+			return float64(f())
+		})
+	}
+	registry.MustRegister(
+		counterFunc("_timestamp_errors", "number of events with unparseable timestamp", limiter.timestamp.Failures),
+		counterFunc("_future_events", "number of events with future timestamps clamped to now", func() int64 {
+			return limiter.Stats().Future
+		}),
+		counterFunc("_late_dropped", "number of rejected events older than limiter window", func() int64 {
+			return limiter.Stats().LateDropped
+		}),
+		counterFunc("_late_allowed", "number of allowed events older than limiter window", func() int64 {
+			return limiter.Stats().LateAllowed
+		}),
+		counterFunc("_late_current", "number of events older than limiter window counted against the current bucket", func() int64 {
+			return limiter.Stats().LateCurrent
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "filebeat",
+			Name:      c.MetricName + "_limiters",
+			Help:      "number of limiters",
+		}, func() float64 {
+			return float64(limiter.LimiterStats().Limiters)
+		}),
+		counterFunc("_limiter_evictions", "number of idle limiters evicted because limiters cap is reached", func() int64 {
+			return limiter.LimiterStats().Evictions
+		}),
+		counterFunc("_limiter_overflows", "number of times shared overflow limiter is used because limiters cap is reached", func() int64 {
+			return limiter.LimiterStats().Overflows
+		}),
+		counterFunc("_limiters_reclaimed", "number of idle limiters removed by janitor", func() int64 {
+			return limiter.LimiterStats().Reclaimed
+		}),
+	)
 
 	processor := &Processor{
 		metric: vec,
 		fields: c.GetFields(),
 		valuesPool: sync.Pool{
 			New: func() interface{} {
-				// "+1" is used because last label is always "throttled".
-				size := len(c.GetFields()) + 1
+				// "+2" is used because last labels are always "rule" and "throttled".
+				size := len(c.GetFields()) + 2
 				return make([]string, size)
 			},
 		},
-		limiter: limiter,
+		limiter:        limiter,
+		delayWait:      delayWait,
+		delayFallbacks: delayFallbacks,
+		registry:       registry,
+	}
+
+	if c.SummaryInterval > 0 {
+		processor.summary = NewSummaryTracker(c.SummaryInterval)
+	}
+
+	if c.Dedup != nil {
+		processor.dedup = NewDeduplicator(*c.Dedup)
+		registry.MustRegister(counterFunc("_dedup_untracked", "number of messages not checked for duplicates because max_messages is reached", processor.dedup.Untracked))
+	}
+
+	if c.DeadLetter != nil && c.DeadLetter.Path != "" {
+		writes := prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "filebeat",
+			Name:      c.MetricName + "_dead_letter_writes",
+			Help:      "number of throttled events written to dead-letter file",
+		})
+		errs := prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "filebeat",
+			Name:      c.MetricName + "_dead_letter_errors",
+			Help:      "number of dead-letter file write errors",
+		})
+		registry.MustRegister(writes, errs)
+
+		processor.dlq, err = NewDeadLetterSink(*c.DeadLetter, writes, errs)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	logp.Info("listening prometheus handler on port: %v", c.PrometheusPort)
-	processor.RunHTTPHandlers(c.PrometheusPort)
+	if err := processor.RunHTTPHandlers(c.PrometheusPort); err != nil {
+		if processor.dlq != nil {
+			processor.dlq.Close()
+		}
+		return nil, err
+	}
+
+	// goroutines are started after all fallible steps, so they don't leak if processor isn't created.
+	ctx, stop := context.WithCancel(context.Background())
+	processor.stop = stop
+
+	processor.background(func() {
+		processor.resetMetric(ctx)
+	})
 
 	logp.Info("initial update for policies...")
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	updateCtx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
 
-	if err := limiter.Update(ctx); err != nil {
+	if err := limiter.Update(updateCtx); err != nil {
 		logp.Err("failed to make initial policy update: %v. Using default", err)
 	}
 
 	logp.Info("limit policy url: %v, updateInterval: %v", c.PolicyHost, c.PolicyUpdateInterval)
-	go limiter.UpdateWithInterval(context.Background(), c.PolicyUpdateInterval)
+	processor.background(func() {
+		limiter.UpdateWithInterval(ctx, c.PolicyUpdateInterval)
+	})
+	processor.runJanitor(ctx, c)
+	if processor.summary != nil || processor.dedup != nil {
+		processor.background(func() {
+			processor.runFlusher(ctx)
+		})
+	}
+	if c.State != nil && c.State.Path != "" {
+		processor.runStateSaver(ctx, *c.State)
+	}
 
 	return processor, nil
 }
 
-// RunHTTPHandlers runs prometheus handler on specified port.
-func (mp *Processor) RunHTTPHandlers(port int) {
-	h := promhttp.Handler()
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", h)
-	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Content-Type", "text/plain")
-		mp.limiter.WriteStatus(w)
+// background runs f in goroutine. f must return when processor context is done, Close waits for it.
+func (mp *Processor) background(f func()) {
+	mp.wg.Add(1)
+	go func() {
+		defer mp.wg.Done()
+		f()
+	}()
+}
+
+// resetMetric periodically resets events counter until ctx is done.
+func (mp *Processor) resetMetric(ctx context.Context) {
+	t := time.NewTicker(metricResetInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			mp.metric.Reset()
+		}
+	}
+}
+
+// runFlusher periodically logs summary and duplicates events that can't be emitted in place of
+// throttled events until ctx is done. Events of open windows are logged on shutdown.
+func (mp *Processor) runFlusher(ctx context.Context) {
+	t := time.NewTicker(summaryCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			now := time.Now()
+			if mp.summary != nil {
+				logEvents("throttle summary", mp.summary.Drain(now))
+			}
+			if mp.dedup != nil {
+				logEvents("throttle duplicates", mp.dedup.Drain(now))
+			}
+			return
+		case now := <-t.C:
+			mp.flush(now)
+		}
+	}
+}
+
+// flush logs summary and duplicates events that weren't emitted in place of throttled events.
+func (mp *Processor) flush(now time.Time) {
+	if mp.summary != nil {
+		logEvents("throttle summary", mp.summary.Flush(now))
+	}
+	if mp.dedup != nil {
+		logEvents("throttle duplicates", mp.dedup.Flush(now))
+	}
+}
+
+// logEvents writes events to log, so they aren't lost if they can't be added to pipeline.
+func logEvents(kind string, events []*beat.Event) {
+	for _, e := range events {
+		logp.Info("%s: %s", kind, e.Fields.String())
+	}
+}
+
+// runStateSaver starts goroutine that periodically saves limiters state, so it's restored after restart.
+func (mp *Processor) runStateSaver(ctx context.Context, c StateConfig) {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultStateInterval
+	}
+
+	mp.background(func() {
+		mp.limiter.RunStateSaver(ctx, c.Path, interval)
 	})
+}
+
+// runJanitor starts goroutine that removes idle limiters, so they are removed even if policy manager is unavailable.
+// By default limiters are checked every bucket and removed if they don't get events during all buckets.
+func (mp *Processor) runJanitor(ctx context.Context, c Config) {
+	interval := c.JanitorInterval
+	if interval <= 0 {
+		interval = time.Duration(c.BucketSize) * time.Second
+	}
+	ttl := c.LimiterTTL
+	if ttl <= 0 {
+		ttl = time.Duration(c.BucketSize*c.Buckets) * time.Second
+	}
+	if interval <= 0 || ttl <= 0 {
+		logp.Err("janitor is disabled: interval %v and limiter ttl %v must be positive", interval, ttl)
+		return
+	}
+
+	mp.background(func() {
+		mp.limiter.RunJanitor(ctx, interval, ttl)
+	})
+}
+
+// RunHTTPHandlers runs prometheus handler of processor metrics on specified port.
+// Processors with the same port share HTTP server, which serves the latest of them, so processor
+// created on config reload takes over port of the previous one. Error is returned if port can't be listened.
+func (mp *Processor) RunHTTPHandlers(port int) error {
+	mp.metricsHandler = promhttp.HandlerFor(mp.registry, promhttp.HandlerOpts{})
+	mp.metricsPort = port
+
 	logp.Info("starting prometheus handler on :%v", port)
-	srv := &http.Server{Addr: fmt.Sprintf(":%v", port), Handler: mux}
-	mp.httpServer = srv
+	if err := serveMetrics(port, mp); err != nil {
+		return err
+	}
+	mp.serving = true
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			logp.Err("failed to run prometheus handler: %v", err)
-		}
-	}()
+	return nil
 }
 
+// Close stops background goroutines and HTTP server. Active HTTP requests are completed
+// during shutdown timeout. Limiters state is saved before Close returns if it's enabled.
 func (mp *Processor) Close() error {
-	return mp.httpServer.Close()
+	if mp.stop != nil {
+		mp.stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var err error
+	if mp.serving {
+		if err = stopMetrics(ctx, mp.metricsPort, mp); err != nil {
+			err = errors.Wrap(err, "failed to shutdown prometheus handler")
+		}
+	}
+	mp.wg.Wait()
+
+	if mp.dlq != nil {
+		if err := mp.dlq.Close(); err != nil {
+			logp.Err("failed to close dead-letter file: %v", err)
+		}
+	}
+
+	return err
 }
 
 func (mp *Processor) Run(event *beat.Event) (*beat.Event, error) {
@@ -182,20 +473,89 @@ func (mp *Processor) Run(event *beat.Event) (*beat.Event, error) {
 		}
 	}
 
-	if !mp.limiter.Allow(event) {
-		mp.throttled++
+	d := mp.limiter.DecideDedup(event, mp.dedup)
+	if d.Duplicate {
+		values[len(values)-2] = d.Rule
+		values[len(values)-1] = "d"
+		mp.metric.WithLabelValues(values...).Inc()
+
+		// duplicates don't take limiter tokens, count of them is emitted instead of one of the next duplicates.
+		return mp.dedup.Next(time.Now()), nil
+	}
+	if !d.Allowed && d.Delay > 0 {
+		d = mp.wait(event, d)
+	}
+	values[len(values)-2] = d.Rule
+	if !d.Allowed {
+		atomic.AddInt64(&mp.throttled, 1)
 		values[len(values)-1] = "y"
 		mp.metric.WithLabelValues(values...).Inc()
+
+		if mp.dlq != nil && d.DeadLetter {
+			mp.dlq.Write(d, event)
+		}
+
+		if mp.summary != nil {
+			// processor can't add new events to pipeline, so summary is emitted instead of throttled event.
+			now := time.Now()
+			mp.summary.Observe(d, event, now)
+			if s := mp.summary.Next(now); s != nil {
+				return s, nil
+			}
+		}
+
 		return nil, nil
 	}
 
-	mp.throttled = 0
+	atomic.StoreInt64(&mp.throttled, 0)
+	if mp.summary != nil || mp.dedup != nil {
+		mp.flush(time.Now())
+	}
 	values[len(values)-1] = "n"
+	switch {
+	case d.SampleRate > 0:
+		values[len(values)-1] = "s"
+		event.PutValue(SampleRateField, d.SampleRate)
+	case d.Throttled:
+		values[len(values)-1] = "t"
+		event.PutValue(ThrottledField, true)
+		event.PutValue(RuleField, d.Rule)
+		event.PutValue(KeyField, d.Key)
+	case d.Annotated:
+		event.PutValue(UtilizationField, d.Utilization)
+	}
 	mp.metric.WithLabelValues(values...).Inc()
 
 	return event, nil
 }
 
+// wait blocks until event delayed by decision d is allowed by limiter or maximum delay is exceeded.
+// Pipeline doesn't receive new events while Run is blocked, so backpressure is applied to harvesters.
+func (mp *Processor) wait(e *beat.Event, d Decision) Decision {
+	start := time.Now()
+	deadline := start.Add(d.Delay)
+	ts := d.Timestamp
+
+	for {
+		sleep := delayPollInterval
+		if remaining := deadline.Sub(time.Now()); remaining < sleep {
+			sleep = remaining
+		}
+		time.Sleep(sleep)
+
+		now := time.Now()
+		d := mp.limiter.Retry(e, ts, now.Sub(start), !now.Before(deadline))
+		// delay is not requested again if event is allowed, fallback is applied or rule is changed by policy update.
+		if d.Delay == 0 {
+			mp.delayWait.Observe(now.Sub(start).Seconds())
+			if d.Fallback {
+				mp.delayFallbacks.Inc()
+			}
+			return d
+		}
+	}
+}
+
 func (mp *Processor) update(ctx context.Context) error {
 	return nil
 }
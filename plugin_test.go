@@ -2,18 +2,27 @@ package throttleplugin
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/elastic/beats/libbeat/beat"
 	"github.com/elastic/beats/libbeat/common"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
 var config = `---
 metric_name: %metric%
 policy_update_interval: 60m
+bucket_size: 60
+buckets: 10
 labels: 
   - 
     from: input.rrrr
@@ -29,6 +38,54 @@ func getConfig() []byte {
 	return []byte(cfg)
 }
 
+// newTestProcessor returns processor that uses policy from test server.
+func newTestProcessor(t *testing.T, policy string) (mp *Processor, closeFn func()) {
+	url, closeServer := testServer(t, []byte(policy))
+	cfg, err := common.NewConfigWithYAML(getConfig(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SetString("policy_host", -1, url)
+
+	mp, err = newProcessor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mp, func() {
+		mp.Close()
+		closeServer()
+	}
+}
+
+func TestProcessor_RunSample(t *testing.T) {
+	mp, closeFn := newTestProcessor(t, `default_limit: 1
+rules:
+  - limit: 1
+    overflow_action: sample
+    sample_rate: 2
+    selectors:
+      app: foo`)
+	defer closeFn()
+
+	newEvent := func() *beat.Event {
+		return newTestEvent(map[string]interface{}{"app": "foo"})
+	}
+
+	e, _ := mp.Run(newEvent())
+	assert.NotNil(t, e)
+	_, err := e.GetValue(SampleRateField)
+	assert.Equal(t, common.ErrKeyNotFound, err)
+
+	e, _ = mp.Run(newEvent())
+	assert.NotNil(t, e)
+	rate, _ := e.GetValue(SampleRateField)
+	assert.Equal(t, int64(2), rate)
+
+	e, _ = mp.Run(newEvent())
+	assert.Nil(t, e)
+}
+
 func TestConfig_GetMetricLabels(t *testing.T) {
 	c := Config{
 		MetricLabels: []LabelMapping{
@@ -73,3 +130,210 @@ func BenchmarkRun(b *testing.B) {
 		mp.Run(event)
 	}
 }
+
+func TestProcessor_RunTag(t *testing.T) {
+	mp, closeFn := newTestProcessor(t, `default_limit: 1
+rules:
+  - name: foo
+    limit: 2
+    overflow_action: tag
+    annotate: true
+    selectors:
+      app: foo`)
+	defer closeFn()
+
+	newEvent := func() *beat.Event {
+		return newTestEvent(map[string]interface{}{"app": "foo"})
+	}
+
+	e, _ := mp.Run(newEvent())
+	utilization, _ := e.GetValue(UtilizationField)
+	assert.Equal(t, 0.5, utilization)
+
+	e, _ = mp.Run(newEvent())
+	utilization, _ = e.GetValue(UtilizationField)
+	assert.Equal(t, 1.0, utilization)
+
+	e, _ = mp.Run(newEvent())
+	if assert.NotNil(t, e, "tagged event must not be dropped") {
+		throttled, _ := e.GetValue(ThrottledField)
+		rule, _ := e.GetValue(RuleField)
+		key, _ := e.GetValue(KeyField)
+
+		assert.Equal(t, true, throttled)
+		assert.Equal(t, "foo", rule)
+		assert.Equal(t, "foo:foo:", key)
+	}
+}
+
+func TestProcessor_RunDelay(t *testing.T) {
+	mp, closeFn := newTestProcessor(t, `default_limit: 1
+rules:
+  - name: foo
+    limit: 1
+    overflow_action: delay
+    max_delay: 100ms
+    delay_fallback: tag
+    selectors:
+      app: foo`)
+	defer closeFn()
+
+	newEvent := func() *beat.Event {
+		return newTestEvent(map[string]interface{}{"app": "foo"})
+	}
+
+	e, _ := mp.Run(newEvent())
+	assert.NotNil(t, e)
+
+	start := time.Now()
+	e, _ = mp.Run(newEvent())
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "event must be delayed")
+	if assert.NotNil(t, e, "fallback action must tag event") {
+		throttled, _ := e.GetValue(ThrottledField)
+		assert.Equal(t, true, throttled)
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(mp.delayFallbacks))
+}
+
+func TestProcessor_RunDedup(t *testing.T) {
+	cfg, err := common.NewConfigWithYAML(getConfig(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, closeServer := testServer(t, []byte(`default_limit: 10`))
+	defer closeServer()
+	cfg.SetString("policy_host", -1, url)
+	cfg.SetBool("dedup.normalize", -1, true)
+
+	mp, err := newProcessor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	e, _ := mp.Run(newTestEvent(map[string]interface{}{"message": "error 1"}))
+	assert.NotNil(t, e)
+	e, _ = mp.Run(newTestEvent(map[string]interface{}{"message": "error 2"}))
+	assert.Nil(t, e, "duplicate must be suppressed")
+	e, _ = mp.Run(newTestEvent(map[string]interface{}{"message": "other"}))
+	assert.NotNil(t, e)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(mp.metric.WithLabelValues(DefaultRuleName, "d")))
+}
+
+func TestProcessor_MultipleInstances(t *testing.T) {
+	cfg, err := common.NewConfigWithYAML(getConfig(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := newProcessor(cfg)
+	assert.NoError(t, err)
+	defer first.Close()
+
+	second, err := newProcessor(cfg)
+	assert.NoError(t, err, "processors with the same metrics must coexist")
+	defer second.Close()
+
+	name, _ := cfg.String("metric_name", -1)
+	first.Run(newTestEvent(map[string]interface{}{"app": "foo"}))
+
+	mfs, err := first.registry.Gather()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, mfs)
+
+	mfs, err = second.registry.Gather()
+	assert.NoError(t, err)
+	for _, mf := range mfs {
+		assert.NotEqual(t, "filebeat_"+name, mf.GetName(), "events of the first processor must not be counted by the second one")
+	}
+}
+
+func TestProcessor_SharedMetricsPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	newPortProcessor := func() (*Processor, string) {
+		cfg, err := common.NewConfigWithYAML(getConfig(), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.SetInt("prometheus_port", -1, int64(port))
+		name, _ := cfg.String("metric_name", -1)
+
+		mp, err := newProcessor(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return mp, name
+	}
+	metrics := func() string {
+		res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+
+		return string(body)
+	}
+
+	// processor created on config reload uses the same port.
+	first, firstName := newPortProcessor()
+	second, secondName := newPortProcessor()
+	defer second.Close()
+
+	assert.Contains(t, metrics(), secondName, "the latest processor must be served")
+	assert.NoError(t, first.Close())
+	assert.Contains(t, metrics(), secondName, "metrics must be served after the previous processor is closed")
+	assert.NotContains(t, metrics(), firstName)
+}
+
+func TestProcessor_PortInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg, err := common.NewConfigWithYAML(getConfig(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SetInt("prometheus_port", -1, int64(ln.Addr().(*net.TCPAddr).Port))
+
+	_, err = newProcessor(cfg)
+	assert.Error(t, err, "processor must not be created if port is used by other process")
+}
+
+func TestProcessor_Close(t *testing.T) {
+	url, closeServer := testServer(t, []byte(`default_limit: 1`))
+	defer closeServer()
+
+	before := runtime.NumGoroutine()
+
+	cfg, err := common.NewConfigWithYAML(getConfig(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SetString("policy_host", -1, url)
+	cfg.SetString("state.path", -1, filepath.Join(t.TempDir(), "throttle.state"))
+
+	mp, err := newProcessor(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Close())
+
+	// keep-alive connections to policy manager aren't owned by processor.
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= before, "all goroutines must be stopped")
+}
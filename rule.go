@@ -1,32 +1,64 @@
 package throttleplugin
 
 import (
-	"bytes"
+	"fmt"
 	"sort"
 	"strconv"
-	"sync"
-	"unsafe"
+	"strings"
+	"time"
 
 	"github.com/elastic/beats/libbeat/beat"
+	"github.com/pkg/errors"
 )
 
-var sbPool sync.Pool
+// Supported actions for events exceeding limit.
+const (
+	// OverflowDrop drops events.
+	OverflowDrop = "drop"
+	// OverflowSample passes 1 of sample rate events and drops others.
+	OverflowSample = "sample"
+	// OverflowTag passes events with additional fields, so they can be routed by later processors or outputs.
+	OverflowTag = "tag"
+	// OverflowDelay delays events until limiter has capacity, so backpressure is applied to harvesters.
+	// If event can't be passed during maximum delay, fallback action is applied.
+	OverflowDelay = "delay"
+)
 
-func init() {
-	sbPool = sync.Pool{
-		New: func() interface{} {
-			return &bytes.Buffer{}
-		},
-	}
-}
+const (
+	// DefaultSampleRate is used by OverflowSample action if sample rate is not specified.
+	DefaultSampleRate = 10
+	// DefaultMaxDelay is used by OverflowDelay action if maximum delay is not specified.
+	DefaultMaxDelay = 10 * time.Second
+)
+
+// DefaultRuleName is the name of rule that is applied to events not matched by any other rule.
+const DefaultRuleName = "default"
 
 type Rule struct {
+	name   string   // stable rule identifier used in limiter keys, metrics and status.
 	keys   []string // sorted list of used keys is used for combining limiter key.
 	values []string // values to check against. order is the same as for keys.
 	limit  int64
 
-	// baseKey contains strings representation of limit to increase Match performance.
-	// strconv.Itoa makes 2 allocations with 32 bytes for each call.
+	limitBytes int64 // maximum number of bytes per bucket, 0 means no bytes limit.
+	priority   int64
+	cost       Cost
+	classes    Classes // priority classes sharing rule limiters.
+	algorithm  string
+	factory    LimiterFactory
+	burst      int64
+	options    map[string]interface{}
+
+	overflowAction string
+	sampleRate     int64
+	maxDelay       time.Duration
+	delayFallback  string
+	annotate       bool // annotate allowed events with bucket utilization.
+	deadLetter     bool // write rejected events to dead-letter file.
+
+	// baseKey is the part of limiter key that identifies rule: name and selector values.
+	// Limits are not part of key, so limiters keep their state when limits are changed.
+	// Selector values of matched events are always the same, so key is built once and Match doesn't allocate.
 	baseKey string
 }
 
@@ -47,29 +79,212 @@ func NewRule(fields map[string]string, limit int64) Rule {
 		values[i] = fields[k]
 	}
 
-	return Rule{
-		keys:    keys,
-		values:  values,
-		limit:   limit,
-		baseKey: strconv.FormatInt(limit, 10),
+	r := Rule{
+		keys:      keys,
+		values:    values,
+		limit:     limit,
+		cost:      NewCost(nil),
+		classes:   Classes{def: 1},
+		algorithm: AlgorithmBucket,
+		factory:   newBucketLimiter,
+
+		overflowAction: OverflowDrop,
+	}
+	r.setName(generateRuleName(keys, values))
+
+	return r
+}
+
+// newRuleFromConfig returns new Rule instance created from remote config.
+func newRuleFromConfig(c RuleConfig) (Rule, error) {
+	r := NewRule(c.Selectors, c.Limit)
+	r.priority = c.Priority
+	r.limitBytes = c.LimitBytes
+	r.cost = NewCost(c.Cost)
+	classes, err := NewClasses(c.Classes)
+	if err != nil {
+		return Rule{}, errors.Wrap(err, "invalid classes")
+	}
+	r.classes = classes
+	r.burst = c.Burst
+	r.options = c.AlgorithmOptions
+	r.annotate = c.Annotate
+	r.deadLetter = c.DeadLetter
+
+	action, err := overflowAction(c.OverflowAction)
+	if err != nil {
+		return Rule{}, err
+	}
+	r.overflowAction = action
+
+	if action == OverflowDelay {
+		r.maxDelay = c.MaxDelay
+		if r.maxDelay <= 0 {
+			r.maxDelay = DefaultMaxDelay
+		}
+
+		r.delayFallback, err = overflowAction(c.DelayFallback)
+		if err != nil {
+			return Rule{}, errors.Wrap(err, "invalid delay fallback")
+		}
+		if r.delayFallback == OverflowDelay {
+			return Rule{}, errors.New("delay can't be used as delay fallback")
+		}
+		action = r.delayFallback
+	}
+
+	if action == OverflowSample {
+		r.sampleRate = c.SampleRate
+		if r.sampleRate <= 0 {
+			r.sampleRate = DefaultSampleRate
+		}
+	}
+
+	if c.Algorithm != "" {
+		f, err := lookupAlgorithm(c.Algorithm)
+		if err != nil {
+			return Rule{}, err
+		}
+		r.algorithm = c.Algorithm
+		r.factory = f
+	}
+
+	name := c.Name
+	if name == "" {
+		name = r.name
+	}
+	// base key depends on algorithm, so it must be updated even if name is generated.
+	r.setName(name)
+
+	return r, nil
+}
+
+// generateRuleName returns name for rule without explicitly specified one.
+// Name is built from selectors, so it doesn't depend on rule position in policy.
+func generateRuleName(keys, values []string) string {
+	if len(keys) == 0 {
+		return "any"
+	}
+
+	var sb strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(values[i])
+	}
+
+	return sb.String()
+}
+
+func (r *Rule) setName(name string) {
+	r.name = name
+	r.baseKey = name
+	if r.algorithm != AlgorithmBucket {
+		// limiter must be recreated if algorithm or its parameters are changed.
+		prefix := r.algorithm + "/" + strconv.FormatInt(r.burst, 10) + "/"
+		if len(r.options) > 0 {
+			prefix += optionsKey(r.options) + "/"
+		}
+		r.baseKey = prefix + r.baseKey
+	}
+
+	r.baseKey += ":"
+	for _, v := range r.values {
+		r.baseKey += v + ":"
+	}
+}
+
+// optionsKey returns short representation of algorithm options, it doesn't depend on map order.
+func optionsKey(options map[string]interface{}) string {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "%s=%v;", k, options[k])
+	}
+
+	return strconv.FormatUint(hashString(sb.String()), 36)
+}
+
+// overflowAction validates overflow action, empty action is treated as OverflowDrop.
+func overflowAction(action string) (string, error) {
+	switch action {
+	case "":
+		return OverflowDrop, nil
+	case OverflowDrop, OverflowSample, OverflowTag, OverflowDelay:
+		return action, nil
+	default:
+		return "", errors.Errorf("unknown overflow action: %q", action)
 	}
 }
 
+// Name returns rule name.
+func (r Rule) Name() string {
+	return r.name
+}
+
+// String returns human-readable rule description.
+func (r Rule) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s: limit=%d limit_bytes=%d priority=%d algorithm=%s overflow=%s selectors=[", r.name, r.limit, r.limitBytes, r.priority, r.algorithm, r.overflowAction)
+	for i, k := range r.keys {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%s:%s", k, r.values[i])
+	}
+	sb.WriteByte(']')
+
+	return sb.String()
+}
+
 // Limit returns current limit.
 func (r Rule) Limit() int64 {
 	return r.limit
 }
 
+// LimitBytes returns current bytes limit.
+func (r Rule) LimitBytes() int64 {
+	return r.limitBytes
+}
+
+// newLimiter creates limiter for rule limit.
+func (r Rule) newLimiter(bucketInterval, buckets int64, now time.Time) Limiter {
+	return r.factory(LimiterParams{
+		BucketInterval: bucketInterval,
+		Buckets:        buckets,
+		Limit:          r.limit,
+		Burst:          r.burst,
+		Options:        r.options,
+	}, now)
+}
+
+// newBytesLimiter creates limiter for rule bytes limit.
+func (r Rule) newBytesLimiter(bucketInterval, buckets int64, now time.Time) Limiter {
+	return r.factory(LimiterParams{
+		BucketInterval: bucketInterval,
+		Buckets:        buckets,
+		Limit:          r.limitBytes,
+		Options:        r.options,
+	}, now)
+}
+
+// limitsEvents returns TRUE if rule limits number of events.
+// Rule with only bytes limit specified doesn't limit number of events.
+func (r Rule) limitsEvents() bool {
+	return r.limit != 0 || r.limitBytes == 0
+}
+
 // Match checks if event has the same field values as expected.
+// key is the part of limiter key that identifies rule.
 func (r Rule) Match(e *beat.Event) (ok bool, key string) {
-	b := sbPool.Get()
-	sb := b.(*bytes.Buffer)
-	sb.Reset()
-	defer func() {
-		sbPool.Put(b)
-	}()
-	sb.WriteString(r.baseKey)
-	sb.WriteByte(':')
 	for i, k := range r.keys {
 		v, err := e.GetValue(k)
 		if err != nil {
@@ -85,14 +300,7 @@ func (r Rule) Match(e *beat.Event) (ok bool, key string) {
 		if sv != r.values[i] {
 			return false, ""
 		}
-
-		sb.WriteString(sv)
-		sb.WriteByte(':')
 	}
 
-	buf := sb.Bytes()
-	// zero-allocation convertion from []bytes to string.
-	s := *(*string)(unsafe.Pointer(&buf))
-
-	return true, s
+	return true, r.baseKey
 }
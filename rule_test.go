@@ -33,7 +33,7 @@ func TestMatch(t *testing.T) {
 		ok, key := r.Match(event)
 
 		assert.True(t, ok)
-		assert.Equal(t, "10:1:", key)
+		assert.Equal(t, "a=1:1:", key)
 	})
 }
 func BenchmarkMatch(b *testing.B) {
@@ -56,3 +56,42 @@ func BenchmarkMatch(b *testing.B) {
 		r.Match(event)
 	}
 }
+
+func TestRule_Name(t *testing.T) {
+	t.Run("explicit", func(t *testing.T) {
+		r, err := newRuleFromConfig(RuleConfig{Name: "foo", Selectors: map[string]string{"a": "1"}, Limit: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", r.Name())
+	})
+
+	t.Run("generated", func(t *testing.T) {
+		r := NewRule(map[string]string{"b": "2", "a": "1"}, 10)
+		assert.Equal(t, "a=1,b=2", r.Name())
+	})
+
+	t.Run("no selectors", func(t *testing.T) {
+		r := NewRule(map[string]string{}, 10)
+		assert.Equal(t, "any", r.Name())
+	})
+}
+
+func TestRule_BaseKey(t *testing.T) {
+	newRule := func(options map[string]interface{}) Rule {
+		r, err := newRuleFromConfig(RuleConfig{
+			Name:             "foo",
+			Limit:            10,
+			Algorithm:        AlgorithmTokenBucket,
+			AlgorithmOptions: options,
+		})
+		assert.NoError(t, err)
+
+		return r
+	}
+
+	base := newRule(nil).baseKey
+	assert.Equal(t, "token_bucket/0/foo:", base)
+	assert.Equal(t, newRule(map[string]interface{}{"a": 1, "b": "x"}).baseKey, newRule(map[string]interface{}{"b": "x", "a": 1}).baseKey)
+	assert.NotEqual(t, newRule(map[string]interface{}{"a": 1}).baseKey, newRule(map[string]interface{}{"a": 2}).baseKey,
+		"limiter must be recreated if algorithm options are changed")
+	assert.NotEqual(t, base, newRule(map[string]interface{}{"a": 1}).baseKey)
+}
@@ -0,0 +1,110 @@
+package throttleplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/pkg/errors"
+)
+
+// metricsServers are HTTP servers of processors metrics by port. Processors with the same port share server,
+// so processor created on config reload serves its metrics while the previous one is still open.
+var (
+	metricsServersMu sync.Mutex
+	metricsServers   = make(map[int]*metricsServer)
+)
+
+// metricsServer serves metrics and status of the latest processor that uses its port.
+type metricsServer struct {
+	srv        *http.Server
+	processors []*Processor  // processors using server, guarded by metricsServersMu.
+	done       chan struct{} // closed when server is stopped.
+}
+
+// serveMetrics registers processor in metrics server of port, server is started if it isn't running yet.
+func serveMetrics(port int, mp *Processor) error {
+	metricsServersMu.Lock()
+	defer metricsServersMu.Unlock()
+
+	if s, ok := metricsServers[port]; ok {
+		s.processors = append(s.processors, mp)
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+	if err != nil {
+		return errors.Wrap(err, "failed to listen prometheus handler")
+	}
+
+	s := &metricsServer{
+		processors: []*Processor{mp},
+		done:       make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if p := s.latest(); p != nil {
+			p.metricsHandler.ServeHTTP(w, r)
+		}
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/plain")
+		if p := s.latest(); p != nil {
+			p.limiter.WriteStatus(w)
+		}
+	})
+	s.srv = &http.Server{Handler: mux}
+	metricsServers[port] = s
+
+	go func() {
+		defer close(s.done)
+		if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logp.Err("failed to run prometheus handler: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// stopMetrics unregisters processor from metrics server of port. Server is stopped when it isn't used by
+// processors anymore, active requests are completed until ctx is done.
+func stopMetrics(ctx context.Context, port int, mp *Processor) error {
+	metricsServersMu.Lock()
+	s, ok := metricsServers[port]
+	if !ok {
+		metricsServersMu.Unlock()
+		return nil
+	}
+	for i, p := range s.processors {
+		if p == mp {
+			s.processors = append(s.processors[:i], s.processors[i+1:]...)
+			break
+		}
+	}
+	if len(s.processors) > 0 {
+		metricsServersMu.Unlock()
+		return nil
+	}
+	delete(metricsServers, port)
+	metricsServersMu.Unlock()
+
+	err := s.srv.Shutdown(ctx)
+	<-s.done
+
+	return err
+}
+
+// latest returns the latest processor that uses server.
+func (s *metricsServer) latest() *Processor {
+	metricsServersMu.Lock()
+	defer metricsServersMu.Unlock()
+
+	if len(s.processors) == 0 {
+		return nil
+	}
+
+	return s.processors[len(s.processors)-1]
+}
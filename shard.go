@@ -0,0 +1,343 @@
+package throttleplugin
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// limiterShards is number of shards in limiterMap. It must be a power of 2.
+	limiterShards = 64
+	// lruResolution is how often used limiter is moved to the front of LRU list.
+	// Limiters aren't moved on every event, so write lock is rarely taken for existing limiters.
+	lruResolution = time.Second
+)
+
+// limiterMap is a concurrent map of limiters sharded by key hash, so goroutines that use
+// different limiters rarely contend for the same lock.
+//
+// Limiters are indexed by 64-bit hash of key, so keys can be looked up from reusable byte
+// buffers without allocations. Limiters with colliding hashes are chained and compared by full key.
+//
+// Number of limiters can be capped. Cap is global: new limiter reserves a slot in atomic counter, so
+// skewed keys don't exhaust cap of some shards while others are empty. When cap is reached, an idle limiter
+// is evicted and its slot is reused. Capped limiters of shard are linked in LRU list, so the least recently
+// used limiter of every shard is checked without scanning shard. Shards are checked starting from the shard
+// of new key, so evicted limiter is the least recently used one of its shard, not necessarily of all shards.
+// When nothing can be evicted, map remembers when the oldest LRU limiter may become idle, so new keys fall back
+// to overflow limiter without locks until then.
+type limiterMap struct {
+	idle      time.Duration // limiter can be evicted if it isn't used during idle interval of wall clock.
+	max       int64         // maximum number of capped limiters, 0 means no limit. Accessed atomically.
+	capped    int64         // number of capped limiters including reserved slots, accessed atomically.
+	fullUntil int64         // unix nanoseconds until cap is reached and nothing can be evicted, accessed atomically.
+	size      int64         // number of limiters, accessed atomically.
+	evictions int64         // number of evicted limiters, accessed atomically.
+	shards    [limiterShards]limiterShard
+}
+
+type limiterShard struct {
+	mu       sync.RWMutex
+	limiters map[uint64]*limiterEntry // key hash -> chain of limiters with this hash.
+	head     *limiterEntry            // the most recently used capped limiter.
+	tail     *limiterEntry            // the least recently used capped limiter.
+}
+
+func newLimiterMap(idle time.Duration) *limiterMap {
+	m := &limiterMap{idle: idle}
+	for i := range m.shards {
+		m.shards[i].limiters = make(map[uint64]*limiterEntry)
+	}
+
+	return m
+}
+
+// setMax sets maximum number of limiters, 0 means no limit.
+func (m *limiterMap) setMax(max int64) {
+	atomic.StoreInt64(&m.max, max)
+	atomic.StoreInt64(&m.fullUntil, 0)
+}
+
+// hashKey returns FNV-1a hash of key.
+func hashKey(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+
+	return h
+}
+
+// hashString returns FNV-1a hash of s, it's calculated in place, so s isn't converted to bytes.
+func hashString(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+
+	return h
+}
+
+// getOrCreate returns limiter for key. If it doesn't exist, create is called to make new one.
+// key isn't retained, so it can point to reusable buffer. create receives copy of key and
+// is called under shard lock, so it must be fast. now is the current time used to track limiters usage.
+// If capped is TRUE and limiters cap is reached, nil is returned unless idle limiter can be evicted.
+func (m *limiterMap) getOrCreate(key []byte, capped bool, now time.Time, create func(key string) *limiterEntry) *limiterEntry {
+	return m.getOrCreateHash(hashKey(key), key, capped, now, create)
+}
+
+// getOrCreateHash is like getOrCreate, but uses precalculated key hash.
+func (m *limiterMap) getOrCreateHash(h uint64, key []byte, capped bool, now time.Time, create func(key string) *limiterEntry) *limiterEntry {
+	s := &m.shards[h&(limiterShards-1)]
+	n := now.UnixNano()
+
+	s.mu.RLock()
+	l := s.find(h, key)
+	s.mu.RUnlock()
+	if l != nil {
+		s.touch(l, n)
+		return l
+	}
+
+	if capped && !m.reserve(h, n) {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// limiter could be created by another goroutine while lock was released.
+	if l := s.find(h, key); l != nil {
+		if capped {
+			// reserved slot isn't used.
+			atomic.AddInt64(&m.capped, -1)
+		}
+		return l
+	}
+
+	l = create(string(key))
+	l.capped = capped
+	l.hash = h
+	l.next = s.limiters[h]
+	s.limiters[h] = l
+	l.used = n
+	if capped {
+		s.pushFront(l)
+	}
+	atomic.AddInt64(&m.size, 1)
+
+	return l
+}
+
+// reserve takes a slot for new capped limiter. If cap is reached, idle limiter is evicted and its slot is reused.
+// FALSE is returned if cap is reached and nothing can be evicted. It must be called without shard lock.
+func (m *limiterMap) reserve(h uint64, n int64) bool {
+	if n < atomic.LoadInt64(&m.fullUntil) {
+		// cap is reached and nothing can be evicted yet.
+		return false
+	}
+
+	for {
+		c := atomic.LoadInt64(&m.capped)
+		if max := atomic.LoadInt64(&m.max); max > 0 && c >= max {
+			break
+		}
+		if atomic.CompareAndSwapInt64(&m.capped, c, c+1) {
+			return true
+		}
+	}
+
+	return m.evict(int(h&(limiterShards-1)), n)
+}
+
+// evict removes the least recently used limiter of the first shard, starting from shard start, whose LRU
+// limiter is idle. If nothing can be evicted, map is full until the oldest LRU limiter may become idle.
+// Shard locks are taken one by one, so it must be called without shard lock.
+func (m *limiterMap) evict(start int, n int64) bool {
+	// usage is tracked with lruResolution, so limiter is idle if it isn't used during idle + lruResolution.
+	// Usage is measured by wall clock, not event time, so limiters of lagging streams aren't evicted.
+	idle := int64(m.idle + lruResolution)
+	oldest := int64(math.MaxInt64)
+
+	for i := 0; i < limiterShards; i++ {
+		s := &m.shards[(start+i)&(limiterShards-1)]
+
+		s.mu.Lock()
+		if s.tail != nil {
+			used := atomic.LoadInt64(&s.tail.used)
+			if used < n-idle {
+				s.remove(s.tail)
+				s.mu.Unlock()
+				atomic.AddInt64(&m.size, -1)
+				atomic.AddInt64(&m.evictions, 1)
+				return true
+			}
+			if used < oldest {
+				oldest = used
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	if oldest != math.MaxInt64 {
+		atomic.StoreInt64(&m.fullUntil, oldest+idle)
+	}
+
+	return false
+}
+
+// touch updates usage time of limiter and moves capped limiter to the front of LRU list.
+// Usage is updated not often than lruResolution.
+func (s *limiterShard) touch(l *limiterEntry, n int64) {
+	if n-atomic.LoadInt64(&l.used) < int64(lruResolution) {
+		return
+	}
+	if !l.capped {
+		atomic.StoreInt64(&l.used, n)
+		return
+	}
+
+	s.mu.Lock()
+	if l.linked {
+		s.unlink(l)
+		s.pushFront(l)
+	}
+	atomic.StoreInt64(&l.used, n)
+	s.mu.Unlock()
+}
+
+// pushFront adds capped limiter to the front of LRU list.
+// Note: this func is not thread safe, so it must be guarded with lock.
+func (s *limiterShard) pushFront(l *limiterEntry) {
+	l.newer = nil
+	l.older = s.head
+	if s.head != nil {
+		s.head.newer = l
+	}
+	s.head = l
+	if s.tail == nil {
+		s.tail = l
+	}
+	l.linked = true
+}
+
+// unlink removes capped limiter from LRU list.
+// Note: this func is not thread safe, so it must be guarded with lock.
+func (s *limiterShard) unlink(l *limiterEntry) {
+	if l.newer != nil {
+		l.newer.older = l.older
+	} else {
+		s.head = l.older
+	}
+	if l.older != nil {
+		l.older.newer = l.newer
+	} else {
+		s.tail = l.newer
+	}
+	l.newer, l.older = nil, nil
+	l.linked = false
+}
+
+// remove deletes limiter from shard. Slot of capped limiter isn't released, it's reused by new limiter.
+// Note: this func is not thread safe, so it must be guarded with lock.
+func (s *limiterShard) remove(l *limiterEntry) {
+	h := l.hash
+	if s.limiters[h] == l {
+		if l.next == nil {
+			delete(s.limiters, h)
+		} else {
+			s.limiters[h] = l.next
+		}
+	} else {
+		for prev := s.limiters[h]; prev != nil; prev = prev.next {
+			if prev.next == l {
+				prev.next = l.next
+				break
+			}
+		}
+	}
+
+	if l.capped {
+		s.unlink(l)
+	}
+}
+
+// find returns limiter with key or nil if it doesn't exist.
+// Note: this func is not thread safe, so it must be guarded with lock.
+func (s *limiterShard) find(h uint64, key []byte) *limiterEntry {
+	for l := s.limiters[h]; l != nil; l = l.next {
+		// conversion in comparison doesn't allocate.
+		if l.key == string(key) {
+			return l
+		}
+	}
+
+	return nil
+}
+
+// rangeAll calls f for every limiter until f returns error.
+func (m *limiterMap) rangeAll(f func(l *limiterEntry) error) error {
+	for i := range m.shards {
+		s := &m.shards[i]
+
+		s.mu.RLock()
+		for _, head := range s.limiters {
+			for l := head; l != nil; l = l.next {
+				if err := f(l); err != nil {
+					s.mu.RUnlock()
+					return err
+				}
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	return nil
+}
+
+// prune removes limiters that weren't used since threshold of wall clock and returns number of removed limiters.
+// Usage is measured by wall clock, not event time, so limiters of streams that lag behind aren't removed.
+func (m *limiterMap) prune(threshold time.Time) int64 {
+	var pruned, capped int64
+	// usage is tracked with lruResolution, so limiter is idle if it isn't used since threshold - lruResolution.
+	t := threshold.Add(-lruResolution).UnixNano()
+
+	for i := range m.shards {
+		s := &m.shards[i]
+
+		s.mu.Lock()
+		for h, head := range s.limiters {
+			var kept *limiterEntry
+			for l := head; l != nil; {
+				next := l.next
+				if atomic.LoadInt64(&l.used) >= t {
+					l.next = kept
+					kept = l
+				} else {
+					pruned++
+					if l.capped {
+						s.unlink(l)
+						capped++
+					}
+				}
+				l = next
+			}
+
+			if kept == nil {
+				delete(s.limiters, h)
+			} else {
+				s.limiters[h] = kept
+			}
+		}
+		s.mu.Unlock()
+	}
+	atomic.AddInt64(&m.size, -pruned)
+	atomic.AddInt64(&m.capped, -capped)
+	atomic.StoreInt64(&m.fullUntil, 0)
+
+	return pruned
+}
@@ -0,0 +1,163 @@
+package throttleplugin
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterMap_Collision(t *testing.T) {
+	now := time.Now()
+	m := newLimiterMap(time.Minute)
+	create := func(key string) *limiterEntry {
+		return &limiterEntry{key: key, Limiter: NewBucketLimiter(60, 1, 1, now)}
+	}
+
+	// different keys with the same hash must get different limiters.
+	old := now.Add(-time.Hour)
+	foo := m.getOrCreateHash(1, []byte("foo"), true, now, create)
+	bar := m.getOrCreateHash(1, []byte("bar"), true, old, create)
+	assert.Equal(t, "foo", foo.key)
+	assert.Equal(t, "bar", bar.key)
+	assert.True(t, foo != bar)
+	assert.True(t, foo == m.getOrCreateHash(1, []byte("foo"), true, now, create))
+	assert.True(t, bar == m.getOrCreateHash(1, []byte("bar"), true, old, create))
+
+	m.prune(now.Add(-time.Minute))
+
+	var keys []string
+	m.rangeAll(func(l *limiterEntry) error {
+		keys = append(keys, l.key)
+		return nil
+	})
+	assert.Equal(t, []string{"foo"}, keys, "only used limiter must be kept in chain")
+}
+
+func TestLimiterMap_KeyIsCopied(t *testing.T) {
+	now := time.Now()
+	m := newLimiterMap(time.Minute)
+	create := func(key string) *limiterEntry {
+		return &limiterEntry{key: key}
+	}
+
+	buf := []byte("foo")
+	l := m.getOrCreate(buf, true, now, create)
+	copy(buf, "bar")
+
+	assert.Equal(t, "foo", l.key, "key must not point to reusable buffer")
+	assert.True(t, l == m.getOrCreate([]byte("foo"), true, now, create))
+}
+
+func TestLimiterMap_Cap(t *testing.T) {
+	now := time.Now()
+	create := func(key string) *limiterEntry {
+		return &limiterEntry{key: key, Limiter: NewBucketLimiter(60, 1, 1, now)}
+	}
+
+	t.Run("active limiters are kept", func(t *testing.T) {
+		m := newLimiterMap(time.Minute)
+		m.setMax(1)
+
+		foo := m.getOrCreateHash(1, []byte("foo"), true, now, create)
+		foo.Allow(now, 1)
+
+		assert.Nil(t, m.getOrCreateHash(1+limiterShards, []byte("bar"), true, now, create), "cap is reached")
+		assert.Nil(t, m.getOrCreateHash(2, []byte("bar"), true, now, create), "cap is global")
+		assert.NotNil(t, m.getOrCreateHash(2, []byte("overflow"), false, now, create), "uncapped limiters aren't limited")
+		assert.True(t, foo == m.getOrCreateHash(1, []byte("foo"), true, now, create), "existing limiter must be returned")
+		assert.Equal(t, int64(2), m.size)
+		assert.Equal(t, int64(1), m.capped)
+		assert.Equal(t, int64(0), m.evictions)
+	})
+
+	t.Run("skewed keys", func(t *testing.T) {
+		m := newLimiterMap(time.Minute)
+		m.setMax(limiterShards)
+
+		// all keys get into the same shard.
+		for i := uint64(0); i < limiterShards; i++ {
+			assert.NotNil(t, m.getOrCreateHash(1+i*limiterShards, []byte(fmt.Sprint(i)), true, now, create))
+		}
+		assert.Nil(t, m.getOrCreateHash(2, []byte("overflow"), true, now, create))
+		assert.Equal(t, int64(limiterShards), m.size)
+	})
+
+	t.Run("idle limiter is evicted", func(t *testing.T) {
+		m := newLimiterMap(0)
+		m.setMax(1)
+
+		m.getOrCreateHash(1, []byte("foo"), true, now, create).Allow(now, 1)
+		bar := m.getOrCreateHash(2, []byte("bar"), true, now.Add(2*lruResolution), create)
+		if assert.NotNil(t, bar) {
+			assert.Equal(t, "bar", bar.key)
+		}
+		assert.Nil(t, m.shards[1].tail, "limiter of other shard must be evicted")
+		assert.Equal(t, int64(1), m.size)
+		assert.Equal(t, int64(1), m.capped)
+		assert.Equal(t, int64(1), m.evictions)
+	})
+}
+
+func TestLimiterMap_LRU(t *testing.T) {
+	now := time.Now()
+	create := func(key string) *limiterEntry {
+		return &limiterEntry{key: key, Limiter: NewBucketLimiter(60, 1, 1, now)}
+	}
+
+	m := newLimiterMap(time.Minute)
+	m.setMax(2)
+
+	foo := m.getOrCreateHash(1, []byte("foo"), true, now, create)
+	bar := m.getOrCreateHash(1+limiterShards, []byte("bar"), true, now, create)
+	s := &m.shards[1]
+	assert.True(t, s.tail == foo)
+
+	// foo is used later than bar, so bar becomes the least recently used limiter.
+	later := now.Add(lruResolution)
+	assert.True(t, foo == m.getOrCreateHash(1, []byte("foo"), true, later, create))
+	assert.True(t, s.tail == bar)
+	assert.True(t, s.head == foo)
+
+	baz := m.getOrCreateHash(1+2*limiterShards, []byte("baz"), true, now.Add(2*time.Minute), create)
+	if assert.NotNil(t, baz) {
+		assert.True(t, s.head == baz)
+		assert.True(t, s.tail == foo)
+	}
+	assert.Equal(t, int64(1), m.evictions, "LRU limiter must be evicted")
+
+	var keys []string
+	m.rangeAll(func(l *limiterEntry) error {
+		keys = append(keys, l.key)
+		return nil
+	})
+	assert.ElementsMatch(t, []string{"foo", "baz"}, keys)
+}
+
+func TestLimiterMap_Full(t *testing.T) {
+	now := time.Now()
+	created := 0
+	create := func(key string) *limiterEntry {
+		created++
+		return &limiterEntry{key: key, Limiter: NewBucketLimiter(60, 1, 1, now)}
+	}
+
+	m := newLimiterMap(time.Minute)
+	m.setMax(1)
+	// limiter of lagging stream isn't idle, because usage is measured by wall clock.
+	m.getOrCreateHash(1, []byte("foo"), true, now, create).Allow(now.Add(-time.Hour), 1)
+
+	assert.Nil(t, m.getOrCreateHash(2, []byte("bar"), true, now, create))
+	assert.Equal(t, now.Add(time.Minute+lruResolution).UnixNano(), m.fullUntil, "map must be full until LRU limiter becomes idle")
+	assert.Nil(t, m.getOrCreateHash(3, []byte("baz"), true, now.Add(time.Second), create))
+
+	assert.NotNil(t, m.getOrCreateHash(2, []byte("bar"), true, now.Add(2*time.Minute), create), "idle limiter must be evicted")
+	assert.Equal(t, 2, created)
+
+	m.prune(now.Add(time.Hour))
+	assert.Equal(t, int64(0), m.fullUntil, "pruned map isn't full")
+	assert.Equal(t, int64(0), m.capped)
+	assert.Nil(t, m.shards[2].head)
+	assert.Nil(t, m.shards[2].tail)
+}
@@ -0,0 +1,41 @@
+package throttleplugin
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/elastic/beats/libbeat/beat"
+)
+
+const (
+	// DefaultSizeField is the field used to measure event size by default.
+	DefaultSizeField = "message"
+	// EventSizeField is special value of size field: event size is measured as length of serialized event fields.
+	EventSizeField = "@event"
+)
+
+// eventSize returns size of event in bytes measured by field value.
+// Missing field means zero size.
+func eventSize(e *beat.Event, field string) int64 {
+	if field == EventSizeField {
+		b, err := json.Marshal(e.Fields)
+		if err != nil {
+			return 0
+		}
+		return int64(len(b))
+	}
+
+	v, err := e.GetValue(field)
+	if err != nil {
+		return 0
+	}
+
+	switch t := v.(type) {
+	case string:
+		return int64(len(t))
+	case []byte:
+		return int64(len(t))
+	default:
+		return int64(len(fmt.Sprintf("%v", v)))
+	}
+}
@@ -0,0 +1,189 @@
+package throttleplugin
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// compile-time check that SlidingWindowLimiter implements Limiter, ShareLimiter and Restorer interfaces.
+var _ Limiter = &SlidingWindowLimiter{}
+var _ ShareLimiter = &SlidingWindowLimiter{}
+var _ Restorer = &SlidingWindowLimiter{}
+
+// SlidingWindowLimiter implements sliding window counter algorithm.
+//
+// Limiter keeps counters for current and previous windows and estimates number of events in the
+// sliding window ending at event time as current counter plus weighted previous counter.
+// Events older than current window are counted into current window.
+type SlidingWindowLimiter struct {
+	mu         sync.Mutex
+	interval   int64 // window interval in seconds.
+	limit      int64
+	windowID   int64 // current window id.
+	current    int64
+	previous   int64
+	lastUpdate time.Time // the latest event time.
+}
+
+// NewSlidingWindowLimiter returns new SlidingWindowLimiter instance.
+func NewSlidingWindowLimiter(interval, limit int64, now time.Time) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{
+		interval: interval,
+		limit:    limit,
+		windowID: timeToBucketID(now, interval),
+	}
+}
+
+// Allow returns TRUE if event with time t and specified cost is allowed to be processed.
+func (sw *SlidingWindowLimiter) Allow(t time.Time, cost int64) bool {
+	return sw.AllowShare(t, cost, 1)
+}
+
+// AllowShare returns TRUE if event fits into share part of window limit.
+func (sw *SlidingWindowLimiter) AllowShare(t time.Time, cost int64, share float64) bool {
+	id := timeToBucketID(t, sw.interval)
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if t.After(sw.lastUpdate) {
+		sw.lastUpdate = t
+	}
+
+	if cost == 0 {
+		return true
+	}
+
+	if id > sw.windowID {
+		if id == sw.windowID+1 {
+			sw.previous = sw.current
+		} else {
+			sw.previous = 0
+		}
+		sw.current = 0
+		sw.windowID = id
+	}
+
+	if sw.estimate(t)+float64(cost) > float64(shareOf(sw.limit, share)) {
+		return false
+	}
+	sw.current += cost
+
+	return true
+}
+
+// estimate returns estimated number of events in sliding window ending at t.
+// Note: this func is not thread safe, so it must be guarded with lock.
+func (sw *SlidingWindowLimiter) estimate(t time.Time) float64 {
+	id := timeToBucketID(t, sw.interval)
+	if id > sw.windowID+1 {
+		return 0
+	}
+
+	// weight of previous window is the part of it that still overlaps sliding window.
+	previous, current := sw.previous, sw.current
+	if id == sw.windowID+1 {
+		previous, current = sw.current, 0
+	}
+
+	weight := 1.0
+	if id >= sw.windowID {
+		elapsed := t.Sub(bucketIDToTime(id, sw.interval))
+		weight -= float64(elapsed) / float64(time.Duration(sw.interval)*time.Second)
+	}
+
+	return float64(previous)*weight + float64(current)
+}
+
+// Utilization returns part of limit used in sliding window ending at t.
+func (sw *SlidingWindowLimiter) Utilization(t time.Time) float64 {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.limit <= 0 {
+		return 1
+	}
+
+	return sw.estimate(t) / float64(sw.limit)
+}
+
+// Cancel returns tokens taken by previous Allow call.
+func (sw *SlidingWindowLimiter) Cancel(t time.Time, cost int64) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.current -= cost
+	if sw.current < 0 {
+		sw.current = 0
+	}
+}
+
+// SetLimit updates limit value.
+func (sw *SlidingWindowLimiter) SetLimit(limit int64) {
+	sw.mu.Lock()
+	sw.limit = limit
+	sw.mu.Unlock()
+}
+
+// LastUpdate returns time of the latest event passed to Allow.
+func (sw *SlidingWindowLimiter) LastUpdate() time.Time {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	return sw.lastUpdate
+}
+
+// slidingWindowState is serializable state of SlidingWindowLimiter.
+type slidingWindowState struct {
+	WindowID int64 `json:"window_id"`
+	Current  int64 `json:"current"`
+	Previous int64 `json:"previous"`
+}
+
+// Snapshot returns serializable limiter state.
+func (sw *SlidingWindowLimiter) Snapshot() Snapshot {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	return newSnapshot(AlgorithmSlidingWindow, sw.limit, sw.lastUpdate, slidingWindowState{
+		WindowID: sw.windowID,
+		Current:  sw.current,
+		Previous: sw.previous,
+	})
+}
+
+// Restore loads window counters from snapshot. Counters of windows older than previous one are discarded.
+func (sw *SlidingWindowLimiter) Restore(s Snapshot) error {
+	var st slidingWindowState
+	if err := unmarshalState(s, AlgorithmSlidingWindow, &st); err != nil {
+		return err
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	switch {
+	case st.WindowID >= sw.windowID:
+		sw.windowID, sw.current, sw.previous = st.WindowID, st.Current, st.Previous
+	case st.WindowID == sw.windowID-1:
+		sw.previous = st.Current
+	}
+	if s.LastUpdate.After(sw.lastUpdate) {
+		sw.lastUpdate = s.LastUpdate
+	}
+
+	return nil
+}
+
+// WriteStatus writes text based status into Writer.
+func (sw *SlidingWindowLimiter) WriteStatus(w io.Writer) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	fmt.Fprintf(w, "#%s: %d/%d\n", bucketIDToTime(sw.windowID-1, sw.interval), sw.previous, sw.limit)
+	fmt.Fprintf(w, "#%s: ", bucketIDToTime(sw.windowID, sw.interval))
+	progress(w, sw.current, sw.limit, 20)
+	fmt.Fprintf(w, " %d/%d\n", sw.current, sw.limit)
+	return nil
+}
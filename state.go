@@ -0,0 +1,198 @@
+package throttleplugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/pkg/errors"
+)
+
+// DefaultStateInterval is used if state save interval is not specified.
+const DefaultStateInterval = 10 * time.Second
+
+// StateConfig defines local file where limiters state is saved, so it isn't reset by restart.
+type StateConfig struct {
+	Path     string        `config:"path"`
+	Interval time.Duration `config:"interval"` // how often state is saved.
+}
+
+// limiterState is the content of state file.
+type limiterState struct {
+	BucketInterval int64           `json:"bucket_interval"`
+	Buckets        int64           `json:"buckets"`
+	SavedAt        time.Time       `json:"saved_at"`
+	Limiters       []limiterRecord `json:"limiters"`
+}
+
+// limiterRecord is a state of one limiter.
+type limiterRecord struct {
+	Key      string   `json:"key"`
+	Rule     string   `json:"rule"`
+	Snapshot Snapshot `json:"snapshot"`
+}
+
+// SaveState writes snapshots of all limiters into Writer.
+func (rl *RemoteLimiter) SaveState(w io.Writer, now time.Time) error {
+	state := limiterState{
+		BucketInterval: rl.bucketInterval,
+		Buckets:        rl.buckets,
+		SavedAt:        now,
+	}
+	rl.limiters.rangeAll(func(l *limiterEntry) error {
+		state.Limiters = append(state.Limiters, limiterRecord{
+			Key:      l.key,
+			Rule:     l.rule,
+			Snapshot: l.Snapshot(),
+		})
+		return nil
+	})
+
+	return errors.Wrap(json.NewEncoder(w).Encode(state), "failed to encode state")
+}
+
+// LoadState reads snapshots written by SaveState and returns number of loaded ones.
+// Limiters aren't created immediately: snapshot is restored when limiter with the same key is created
+// by rule of current policy, so limiters get actual limits and algorithm parameters.
+//
+// Snapshots that didn't get events during the last bucket_size * buckets are discarded because
+// their windows are expired. If bucket_size is changed, all snapshots are discarded.
+func (rl *RemoteLimiter) LoadState(r io.Reader, now time.Time) (int, error) {
+	var state limiterState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return 0, errors.Wrap(err, "failed to decode state")
+	}
+
+	if state.BucketInterval != rl.bucketInterval {
+		logp.Info("throttle state is discarded: bucket size is changed from %d to %d", state.BucketInterval, rl.bucketInterval)
+		return 0, nil
+	}
+
+	threshold := now.Add(-time.Duration(rl.bucketInterval*rl.buckets) * time.Second)
+	snapshots := make(map[string]Snapshot, len(state.Limiters))
+	for _, l := range state.Limiters {
+		if l.Snapshot.LastUpdate.Before(threshold) {
+			continue
+		}
+		snapshots[l.Key] = l.Snapshot
+	}
+
+	rl.restoreMu.Lock()
+	rl.snapshots = snapshots
+	rl.setRestorePending()
+	rl.restoreMu.Unlock()
+
+	return len(snapshots), nil
+}
+
+// SaveStateFile writes state into file. File is replaced atomically, so it's never partially written.
+func (rl *RemoteLimiter) SaveStateFile(path string, now time.Time) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create state file")
+	}
+
+	if err := rl.SaveState(f, now); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to sync state file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close state file")
+	}
+
+	return errors.Wrap(os.Rename(tmp, path), "failed to replace state file")
+}
+
+// LoadStateFile reads state from file. Missing file isn't an error, it means that there is no saved state.
+func (rl *RemoteLimiter) LoadStateFile(path string, now time.Time) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open state file")
+	}
+	defer f.Close()
+
+	return rl.LoadState(f, now)
+}
+
+// RunStateSaver saves state into file every interval until ctx is done.
+// State is saved once more before return, so the latest state is kept on shutdown.
+func (rl *RemoteLimiter) RunStateSaver(ctx context.Context, path string, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := rl.SaveStateFile(path, time.Now()); err != nil {
+				logp.Err("failed to save throttle state: %v", err)
+			}
+			return ctx.Err()
+		case now := <-t.C:
+			if err := rl.SaveStateFile(path, now); err != nil {
+				logp.Err("failed to save throttle state: %v", err)
+			}
+		}
+	}
+}
+
+// restore loads saved snapshot into new limiter with the same key. Snapshot is used only once.
+// It's called on every limiter creation, so restoreMu isn't taken once all snapshots are used or pruned.
+func (rl *RemoteLimiter) restore(key string, l Limiter) {
+	if atomic.LoadInt32(&rl.restorePending) == 0 {
+		return
+	}
+
+	rl.restoreMu.Lock()
+	s, ok := rl.snapshots[key]
+	if ok {
+		delete(rl.snapshots, key)
+		rl.setRestorePending()
+	}
+	rl.restoreMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	r, ok := l.(Restorer)
+	if !ok {
+		return
+	}
+	if err := r.Restore(s); err != nil {
+		logp.Debug("throttle", "failed to restore limiter %q: %v", key, err)
+	}
+}
+
+// pruneSnapshots removes saved snapshots that weren't restored and whose windows are expired.
+func (rl *RemoteLimiter) pruneSnapshots(threshold time.Time) {
+	rl.restoreMu.Lock()
+	defer rl.restoreMu.Unlock()
+
+	for key, s := range rl.snapshots {
+		if s.LastUpdate.Before(threshold) {
+			delete(rl.snapshots, key)
+		}
+	}
+	rl.setRestorePending()
+}
+
+// setRestorePending updates restorePending flag after snapshots are changed. restoreMu must be held.
+func (rl *RemoteLimiter) setRestorePending() {
+	var pending int32
+	if len(rl.snapshots) > 0 {
+		pending = 1
+	}
+	atomic.StoreInt32(&rl.restorePending, pending)
+}
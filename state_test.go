@@ -0,0 +1,167 @@
+package throttleplugin
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+const statePolicy = `default_limit: 2
+rules:
+  - name: foo-rule
+    limit: 3
+    selectors:
+      app: foo
+  - name: token-rule
+    limit: 1
+    algorithm: token_bucket
+    selectors:
+      app: bar`
+
+func newStateLimiter(t *testing.T, bucketInterval int64) *RemoteLimiter {
+	url, closeFn := testServer(t, []byte(statePolicy))
+	defer closeFn()
+
+	l, _ := NewRemoteLimiter(url, bucketInterval, 10)
+	assert.NoError(t, l.Update(context.Background()))
+
+	return l
+}
+
+func TestRemoteLimiter_LoadState(t *testing.T) {
+	l := newStateLimiter(t, 60)
+
+	foo := newTestEvent(map[string]interface{}{"app": "foo"})
+	bar := newTestEvent(map[string]interface{}{"app": "bar"})
+	baz := newTestEvent(map[string]interface{}{"app": "baz"})
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow(foo))
+	}
+	assert.True(t, l.Allow(bar))
+	assert.True(t, l.Allow(baz))
+
+	var b bytes.Buffer
+	assert.NoError(t, l.SaveState(&b, time.Now()))
+	state := b.Bytes()
+
+	restored := newStateLimiter(t, 60)
+	n, err := restored.LoadState(bytes.NewReader(state), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	assert.False(t, restored.Allow(foo), "bucket must be restored")
+	assert.False(t, restored.Allow(bar), "token bucket must be restored")
+	assert.True(t, restored.Allow(baz))
+	assert.False(t, restored.Allow(baz), "default rule bucket must be restored")
+
+	resized := newStateLimiter(t, 30)
+	n, err = resized.LoadState(bytes.NewReader(state), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "state must be discarded if bucket size is changed")
+	assert.True(t, resized.Allow(foo))
+
+	expired := newStateLimiter(t, 60)
+	n, err = expired.LoadState(bytes.NewReader(state), time.Now().Add(10*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "expired snapshots must be discarded")
+
+	_, err = expired.LoadState(bytes.NewReader([]byte("{")), time.Now())
+	assert.Error(t, err)
+}
+
+func TestRemoteLimiter_LoadStatePrune(t *testing.T) {
+	l := newStateLimiter(t, 60)
+	assert.True(t, l.Allow(newTestEvent(map[string]interface{}{"app": "foo"})))
+
+	var b bytes.Buffer
+	assert.NoError(t, l.SaveState(&b, time.Now()))
+
+	restored := newStateLimiter(t, 60)
+	_, err := restored.LoadState(&b, time.Now())
+	assert.NoError(t, err)
+
+	assert.Equal(t, int32(1), restored.restorePending)
+
+	restored.Prune(time.Now().Add(time.Minute))
+	assert.Empty(t, restored.snapshots, "snapshots that weren't restored must be pruned")
+	assert.Equal(t, int32(0), restored.restorePending, "restore must skip lock when there are no snapshots")
+}
+
+func TestRemoteLimiter_RestorePending(t *testing.T) {
+	l := newStateLimiter(t, 60)
+	foo := newTestEvent(map[string]interface{}{"app": "foo"})
+	assert.True(t, l.Allow(foo))
+
+	var b bytes.Buffer
+	assert.NoError(t, l.SaveState(&b, time.Now()))
+
+	restored := newStateLimiter(t, 60)
+	assert.Equal(t, int32(0), restored.restorePending)
+	n, err := restored.LoadState(&b, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, int32(1), restored.restorePending)
+
+	assert.True(t, restored.Allow(foo))
+	assert.Empty(t, restored.snapshots)
+	assert.Equal(t, int32(0), restored.restorePending, "flag must be cleared when the last snapshot is restored")
+}
+
+func TestRemoteLimiter_SaveStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "throttle.state")
+
+	l := newStateLimiter(t, 60)
+	n, err := l.LoadStateFile(path, time.Now())
+	assert.NoError(t, err, "missing state file isn't an error")
+	assert.Equal(t, 0, n)
+
+	assert.True(t, l.Allow(newTestEvent(map[string]interface{}{"app": "foo"})))
+	assert.NoError(t, l.SaveStateFile(path, time.Now()))
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err), "temporary file must be renamed")
+
+	n, err = newStateLimiter(t, 60).LoadStateFile(path, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestProcessor_RestoreState(t *testing.T) {
+	url, closeServer := testServer(t, []byte(statePolicy))
+	defer closeServer()
+	path := filepath.Join(t.TempDir(), "throttle.state")
+
+	newStateProcessor := func() *Processor {
+		cfg, err := common.NewConfigWithYAML(getConfig(), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.SetString("policy_host", -1, url)
+		cfg.SetString("state.path", -1, path)
+
+		mp, err := newProcessor(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return mp
+	}
+
+	mp := newStateProcessor()
+	for i := 0; i < 3; i++ {
+		e, _ := mp.Run(newTestEvent(map[string]interface{}{"app": "foo"}))
+		assert.NotNil(t, e)
+	}
+	assert.NoError(t, mp.Close())
+	assert.FileExists(t, path, "state must be saved on close")
+
+	mp = newStateProcessor()
+	defer mp.Close()
+	e, _ := mp.Run(newTestEvent(map[string]interface{}{"app": "foo"}))
+	assert.Nil(t, e, "limit must be exceeded after restart")
+}
@@ -0,0 +1,177 @@
+package throttleplugin
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// summaryCheckInterval limits how often closed windows are looked up.
+const summaryCheckInterval = time.Second
+
+// SummaryTracker accumulates throttled events per limiter key and builds summary events
+// when throttle window closes.
+//
+// Processor can't add events to pipeline, so summary is emitted in place of one of the next throttled events.
+// If throttling stops, summary waits for such event during interval and then it's returned by Flush.
+type SummaryTracker struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	windows   map[string]*throttleWindow // limiter key -> current window.
+	ready     []*throttleWindow          // closed windows waiting to be emitted, ordered by close time.
+	nextCheck time.Time
+	nextFlush int64 // unix nanoseconds of the next Flush check, accessed atomically.
+}
+
+// throttleWindow contains information about events throttled by one limiter during window.
+type throttleWindow struct {
+	key     string
+	rule    string
+	fields  common.MapStr // fields of the first throttled event, used to put summary next to original events.
+	start   time.Time
+	end     time.Time // time when window is closed.
+	dropped int64
+	first   time.Time // timestamp of the first throttled event.
+	last    time.Time // timestamp of the last throttled event.
+}
+
+// NewSummaryTracker returns new SummaryTracker instance.
+func NewSummaryTracker(interval time.Duration) *SummaryTracker {
+	return &SummaryTracker{
+		interval: interval,
+		windows:  make(map[string]*throttleWindow),
+	}
+}
+
+// Observe registers throttled event e with timestamp ts.
+func (st *SummaryTracker) Observe(d Decision, e *beat.Event, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	w, ok := st.windows[d.Key]
+	if !ok {
+		fields := e.Fields.Clone()
+		fields.Delete("message")
+
+		w = &throttleWindow{
+			key:    d.Key,
+			rule:   d.Rule,
+			fields: fields,
+			start:  now,
+			first:  d.Timestamp,
+			last:   d.Timestamp,
+		}
+		st.windows[d.Key] = w
+	}
+
+	w.dropped++
+	if d.Timestamp.Before(w.first) {
+		w.first = d.Timestamp
+	}
+	if d.Timestamp.After(w.last) {
+		w.last = d.Timestamp
+	}
+}
+
+// Next returns summary event for one of closed windows or nil if there are no closed windows.
+func (st *SummaryTracker) Next(now time.Time) *beat.Event {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.collect(now)
+	if len(st.ready) == 0 {
+		return nil
+	}
+
+	w := st.ready[0]
+	st.ready[0] = nil
+	st.ready = st.ready[1:]
+
+	return w.event()
+}
+
+// Flush closes expired windows and returns summaries that weren't emitted in place of throttled events
+// during interval after their windows are closed, so summary of limiter that isn't throttled anymore isn't lost.
+// It's called periodically and on allowed events.
+func (st *SummaryTracker) Flush(now time.Time) []*beat.Event {
+	// Flush is called on allowed events, so lock isn't taken more often than summaryCheckInterval.
+	if now.UnixNano() < atomic.LoadInt64(&st.nextFlush) {
+		return nil
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.collect(now)
+	atomic.StoreInt64(&st.nextFlush, st.nextCheck.UnixNano())
+
+	var events []*beat.Event
+	for len(st.ready) > 0 && now.Sub(st.ready[0].end) >= st.interval {
+		events = append(events, st.ready[0].event())
+		st.ready[0] = nil
+		st.ready = st.ready[1:]
+	}
+
+	return events
+}
+
+// Drain closes all windows and returns summaries of them and of closed windows that aren't emitted yet.
+// It's used on shutdown.
+func (st *SummaryTracker) Drain(now time.Time) []*beat.Event {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	events := make([]*beat.Event, 0, len(st.ready)+len(st.windows))
+	for _, w := range st.ready {
+		events = append(events, w.event())
+	}
+	for _, w := range st.windows {
+		w.end = now
+		events = append(events, w.event())
+	}
+	st.ready = nil
+	st.windows = make(map[string]*throttleWindow)
+
+	return events
+}
+
+// collect closes expired windows. Windows are looked up not often than summaryCheckInterval.
+// Note: this func is not thread safe, so it must be guarded with lock.
+func (st *SummaryTracker) collect(now time.Time) {
+	if now.Before(st.nextCheck) {
+		return
+	}
+	st.nextCheck = now.Add(summaryCheckInterval)
+
+	for key, w := range st.windows {
+		if now.Sub(w.start) >= st.interval {
+			w.end = now
+			st.ready = append(st.ready, w)
+			delete(st.windows, key)
+		}
+	}
+}
+
+// event builds summary event.
+func (w *throttleWindow) event() *beat.Event {
+	fields := w.fields
+	fields["message"] = fmt.Sprintf("throttled %d events by rule %q", w.dropped, w.rule)
+	fields["throttle"] = common.MapStr{
+		"summary":       true,
+		"key":           w.key,
+		"rule":          w.rule,
+		"dropped":       w.dropped,
+		"window":        common.MapStr{"start": w.start, "end": w.end},
+		"first_dropped": w.first,
+		"last_dropped":  w.last,
+	}
+
+	return &beat.Event{
+		Timestamp: w.end,
+		Fields:    fields,
+	}
+}
@@ -0,0 +1,89 @@
+package throttleplugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummaryTracker(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	st := NewSummaryTracker(time.Minute)
+
+	e := newTestEvent(map[string]interface{}{"message": "foo", "app": "foo"})
+	first := now.Add(-time.Second)
+	last := now.Add(10 * time.Second)
+
+	st.Observe(Decision{Rule: "rule", Key: "key", Timestamp: last}, e, now)
+	st.Observe(Decision{Rule: "rule", Key: "key", Timestamp: first}, e, now)
+	st.Observe(Decision{Rule: "rule", Key: "other", Timestamp: now}, e, now.Add(30*time.Second))
+
+	assert.Nil(t, st.Next(now.Add(59500*time.Millisecond)), "window must be still open")
+	assert.Nil(t, st.Next(now.Add(60*time.Second)), "closed windows must be checked not often than summaryCheckInterval")
+
+	end := now.Add(61 * time.Second)
+	s := st.Next(end)
+	if assert.NotNil(t, s) {
+		assert.Equal(t, end, s.Timestamp)
+		assert.Equal(t, common.MapStr{
+			"app":     "foo",
+			"message": `throttled 2 events by rule "rule"`,
+			"throttle": common.MapStr{
+				"summary":       true,
+				"key":           "key",
+				"rule":          "rule",
+				"dropped":       int64(2),
+				"window":        common.MapStr{"start": now, "end": end},
+				"first_dropped": first,
+				"last_dropped":  last,
+			},
+		}, s.Fields)
+	}
+	assert.Nil(t, st.Next(end))
+
+	// original event must be untouched.
+	assert.Equal(t, common.MapStr{"message": "foo", "app": "foo"}, e.Fields)
+
+	s = st.Next(end.Add(30 * time.Second))
+	if assert.NotNil(t, s) {
+		key, _ := s.GetValue("throttle.key")
+		assert.Equal(t, "other", key)
+	}
+}
+
+func TestSummaryTracker_Flush(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	st := NewSummaryTracker(time.Minute)
+
+	e := newTestEvent(map[string]interface{}{"message": "foo", "app": "foo"})
+	st.Observe(Decision{Rule: "rule", Key: "key", Timestamp: now}, e, now)
+
+	// throttling stops, so there are no events to emit summary in place of.
+	closed := now.Add(time.Minute)
+	assert.Empty(t, st.Flush(closed), "summary must wait for throttled event during interval")
+	assert.Empty(t, st.Flush(closed.Add(30*time.Second)))
+	assert.Empty(t, st.windows, "closed window must be removed")
+
+	events := st.Flush(closed.Add(time.Minute))
+	if assert.Len(t, events, 1) {
+		dropped, _ := events[0].GetValue("throttle.dropped")
+		assert.Equal(t, int64(1), dropped)
+		assert.Equal(t, closed, events[0].Timestamp)
+	}
+	assert.Nil(t, st.Next(closed.Add(time.Hour)), "flushed summary must not be emitted twice")
+}
+
+func TestSummaryTracker_Drain(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	st := NewSummaryTracker(time.Minute)
+
+	e := newTestEvent(map[string]interface{}{"app": "foo"})
+	st.Observe(Decision{Rule: "rule", Key: "key", Timestamp: now}, e, now)
+	st.Observe(Decision{Rule: "rule", Key: "other", Timestamp: now}, e, now.Add(50*time.Second))
+	assert.Empty(t, st.Flush(now.Add(time.Minute)))
+
+	assert.Len(t, st.Drain(now.Add(70*time.Second)), 2, "closed and open windows must be drained")
+	assert.Empty(t, st.Drain(now.Add(80*time.Second)))
+}
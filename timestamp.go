@@ -0,0 +1,170 @@
+package throttleplugin
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// DefaultTimestampField is used if timestamp field is not specified. It's the beat.Event.Timestamp.
+const DefaultTimestampField = "@timestamp"
+
+// Named timestamp formats. Any other format is treated as Go time layout.
+const (
+	TimestampRFC3339     = "rfc3339"
+	TimestampRFC3339Nano = "rfc3339nano"
+	TimestampUnix        = "unix"    // seconds since epoch, may be fractional.
+	TimestampUnixMillis  = "unix_ms" // milliseconds since epoch.
+	TimestampUnixNanos   = "unix_ns" // nanoseconds since epoch.
+)
+
+// TimestampParser extracts event timestamps used by limiters.
+type TimestampParser struct {
+	field    string
+	formats  []string
+	failures int64 // number of timestamps that can't be parsed, accessed atomically.
+}
+
+// NewTimestampParser returns new TimestampParser instance.
+// Formats are tried in order, RFC3339 is used if formats are not specified.
+func NewTimestampParser(field string, formats []string) *TimestampParser {
+	if field == "" {
+		field = DefaultTimestampField
+	}
+	if len(formats) == 0 {
+		formats = []string{TimestampRFC3339}
+	}
+
+	return &TimestampParser{
+		field:   field,
+		formats: formats,
+	}
+}
+
+// Timestamp returns timestamp of event. If timestamp field is missing or can't be parsed,
+// beat.Event.Timestamp is used, or now if it's not set.
+func (p *TimestampParser) Timestamp(e *beat.Event, now time.Time) time.Time {
+	v, err := e.GetValue(p.field)
+	if err == nil {
+		ts, ok := p.parse(v)
+		if !ok {
+			atomic.AddInt64(&p.failures, 1)
+		}
+		if !ts.IsZero() {
+			return ts
+		}
+	}
+
+	if !e.Timestamp.IsZero() {
+		return e.Timestamp
+	}
+
+	return now
+}
+
+// Failures returns number of timestamps that can't be parsed.
+func (p *TimestampParser) Failures() int64 {
+	return atomic.LoadInt64(&p.failures)
+}
+
+// parse converts field value to time. Zero time with TRUE means that timestamp is not set.
+func (p *TimestampParser) parse(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case common.Time:
+		return time.Time(t), true
+	case string:
+		for _, f := range p.formats {
+			if ts, ok := parseTimestamp(t, f); ok {
+				return ts, true
+			}
+		}
+		return time.Time{}, false
+	}
+
+	n, ok := toFloat(v)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	for _, f := range p.formats {
+		if f == TimestampUnixNanos {
+			// float64 can't represent current time in nanoseconds precisely.
+			if i, ok := v.(int64); ok {
+				return time.Unix(0, i), true
+			}
+		}
+		if ts, ok := unixTimestamp(n, f); ok {
+			return ts, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// parseTimestamp parses string timestamp in format f.
+func parseTimestamp(s, f string) (time.Time, bool) {
+	var layout string
+
+	switch f {
+	case TimestampRFC3339:
+		layout = time.RFC3339
+	case TimestampRFC3339Nano:
+		layout = time.RFC3339Nano
+	case TimestampUnix, TimestampUnixMillis, TimestampUnixNanos:
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil && f == TimestampUnixNanos {
+			return time.Unix(0, i), true
+		}
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return unixTimestamp(n, f)
+	default:
+		layout = f
+	}
+
+	ts, err := time.Parse(layout, s)
+	return ts, err == nil
+}
+
+// unixTimestamp converts number of units since epoch to time.
+func unixTimestamp(n float64, f string) (time.Time, bool) {
+	switch f {
+	case TimestampUnix:
+		return time.Unix(0, int64(n*float64(time.Second))), true
+	case TimestampUnixMillis:
+		return time.Unix(0, int64(n*float64(time.Millisecond))), true
+	case TimestampUnixNanos:
+		return time.Unix(0, int64(n)), true
+	}
+
+	return time.Time{}, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case uint:
+		return float64(t), true
+	case uint32:
+		return float64(t), true
+	case uint64:
+		return float64(t), true
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,65 @@
+package throttleplugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimestampParser_Timestamp(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	ts := time.Date(2018, 12, 19, 19, 30, 0, 0, time.UTC)
+	nano := time.Date(2018, 12, 19, 19, 30, 0, 123456789, time.UTC)
+
+	cases := []struct {
+		name    string
+		field   string
+		formats []string
+		value   interface{}
+		ts      time.Time
+		failed  bool
+	}{
+		{"rfc3339", "ts", nil, "2018-12-19T19:30:00Z", ts, false},
+		{"rfc3339nano", "ts", []string{TimestampRFC3339Nano}, "2018-12-19T19:30:00.123456789Z", nano, false},
+		{"unix", "ts", []string{TimestampUnix}, ts.Unix(), ts, false},
+		{"unix float", "ts", []string{TimestampUnix}, 1545247800.5, ts.Add(500 * time.Millisecond), false},
+		{"unix string", "ts", []string{TimestampUnix}, "1545247800", ts, false},
+		{"unix millis", "ts", []string{TimestampUnixMillis}, ts.Unix() * 1000, ts, false},
+		{"unix nanos", "ts", []string{TimestampUnixNanos}, nano.UnixNano(), nano, false},
+		{"unix nanos string", "ts", []string{TimestampUnixNanos}, "1545247800123456789", nano, false},
+		{"custom layout", "ts", []string{"2006-01-02 15:04:05"}, "2018-12-19 19:30:00", ts, false},
+		{"second format", "ts", []string{TimestampUnix, TimestampRFC3339}, "2018-12-19T19:30:00Z", ts, false},
+		{"time", "ts", nil, ts, ts, false},
+		{"common time", "ts", nil, common.Time(ts), ts, false},
+		{"missing", "other", nil, "2018-12-19T19:30:00Z", now, false},
+		{"invalid", "ts", nil, "foo", now, true},
+		{"not a string", "ts", nil, 12345, now, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := NewTimestampParser(c.field, c.formats)
+			e := newTestEvent(map[string]interface{}{"ts": c.value})
+
+			assert.True(t, c.ts.Equal(p.Timestamp(e, now)), "expected %s, got %s", c.ts, p.Timestamp(e, now))
+			assert.Equal(t, c.failed, p.Failures() > 0)
+		})
+	}
+}
+
+func TestTimestampParser_EventTimestamp(t *testing.T) {
+	now := time.Date(2018, 12, 19, 19, 30, 25, 0, time.UTC)
+	ts := time.Date(2018, 12, 19, 19, 30, 0, 0, time.UTC)
+
+	p := NewTimestampParser("", nil)
+	assert.Equal(t, ts, p.Timestamp(&beat.Event{Timestamp: ts, Fields: common.MapStr{}}, now))
+	assert.Equal(t, now, p.Timestamp(&beat.Event{Fields: common.MapStr{}}, now), "now must be used if event timestamp isn't set")
+
+	p = NewTimestampParser("ts", nil)
+	e := &beat.Event{Timestamp: ts, Fields: common.MapStr{"ts": "foo"}}
+	assert.Equal(t, ts, p.Timestamp(e, now), "event timestamp must be used as fallback")
+	assert.Equal(t, int64(1), p.Failures())
+}
@@ -0,0 +1,175 @@
+package throttleplugin
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// compile-time check that TokenBucketLimiter implements Limiter, ShareLimiter and Restorer interfaces.
+var _ Limiter = &TokenBucketLimiter{}
+var _ ShareLimiter = &TokenBucketLimiter{}
+var _ Restorer = &TokenBucketLimiter{}
+
+// TokenBucketLimiter implements token bucket algorithm as GCRA (generic cell rate algorithm).
+//
+// Bucket is refilled with limit tokens every interval and can hold at most burst tokens.
+// Instead of storing number of tokens limiter stores theoretical arrival time (TAT) of next event,
+// so state is a single timestamp. Event timestamps are used as current time.
+type TokenBucketLimiter struct {
+	mu         sync.Mutex
+	interval   time.Duration // refill interval.
+	limit      int64         // number of tokens added every interval.
+	burst      int64         // bucket capacity.
+	emission   time.Duration // time required to refill one token.
+	tat        time.Time     // theoretical arrival time.
+	lastUpdate time.Time     // the latest event time.
+}
+
+// NewTokenBucketLimiter returns new TokenBucketLimiter instance.
+// If burst is not positive, it's equal to limit.
+func NewTokenBucketLimiter(bucketInterval, limit, burst int64, now time.Time) *TokenBucketLimiter {
+	tb := &TokenBucketLimiter{
+		interval: time.Duration(bucketInterval) * time.Second,
+		burst:    burst,
+		tat:      now,
+	}
+	tb.setLimit(limit)
+
+	return tb
+}
+
+// Allow returns TRUE if event with time t and specified cost is allowed to be processed.
+func (tb *TokenBucketLimiter) Allow(t time.Time, cost int64) bool {
+	return tb.AllowShare(t, cost, 1)
+}
+
+// AllowShare returns TRUE if event fits into share part of bucket capacity.
+func (tb *TokenBucketLimiter) AllowShare(t time.Time, cost int64, share float64) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if t.After(tb.lastUpdate) {
+		tb.lastUpdate = t
+	}
+
+	if cost == 0 {
+		return true
+	}
+	if tb.limit <= 0 {
+		return false
+	}
+
+	tat := tb.tat
+	if t.After(tat) {
+		tat = t
+	}
+
+	tat = tat.Add(time.Duration(cost) * tb.emission)
+	// event is allowed if bucket doesn't overflow: TAT is not further than burst from now.
+	if tat.Sub(t) > time.Duration(shareOf(tb.capacity(), share))*tb.emission {
+		return false
+	}
+	tb.tat = tat
+
+	return true
+}
+
+// Cancel returns tokens taken by previous Allow call.
+func (tb *TokenBucketLimiter) Cancel(t time.Time, cost int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.tat = tb.tat.Add(-time.Duration(cost) * tb.emission)
+}
+
+// SetLimit updates limit value.
+func (tb *TokenBucketLimiter) SetLimit(limit int64) {
+	tb.mu.Lock()
+	tb.setLimit(limit)
+	tb.mu.Unlock()
+}
+
+func (tb *TokenBucketLimiter) setLimit(limit int64) {
+	tb.limit = limit
+	if limit > 0 {
+		tb.emission = tb.interval / time.Duration(limit)
+	}
+}
+
+// capacity returns bucket capacity.
+// Note: this func is not thread safe, so it must be guarded with lock.
+func (tb *TokenBucketLimiter) capacity() int64 {
+	if tb.burst > 0 {
+		return tb.burst
+	}
+
+	return tb.limit
+}
+
+// LastUpdate returns time of the latest event passed to Allow.
+func (tb *TokenBucketLimiter) LastUpdate() time.Time {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	return tb.lastUpdate
+}
+
+// Utilization returns part of bucket capacity used at time t.
+func (tb *TokenBucketLimiter) Utilization(t time.Time) float64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if tb.limit <= 0 {
+		return 1
+	}
+
+	used := tb.tat.Sub(t)
+	if used <= 0 {
+		return 0
+	}
+
+	return float64(used) / float64(time.Duration(tb.capacity())*tb.emission)
+}
+
+// tokenBucketState is serializable state of TokenBucketLimiter.
+type tokenBucketState struct {
+	TAT time.Time `json:"tat"`
+}
+
+// Snapshot returns serializable limiter state.
+func (tb *TokenBucketLimiter) Snapshot() Snapshot {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	return newSnapshot(AlgorithmTokenBucket, tb.limit, tb.lastUpdate, tokenBucketState{TAT: tb.tat})
+}
+
+// Restore loads theoretical arrival time from snapshot if it's later than current one.
+func (tb *TokenBucketLimiter) Restore(s Snapshot) error {
+	var st tokenBucketState
+	if err := unmarshalState(s, AlgorithmTokenBucket, &st); err != nil {
+		return err
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if st.TAT.After(tb.tat) {
+		tb.tat = st.TAT
+	}
+	if s.LastUpdate.After(tb.lastUpdate) {
+		tb.lastUpdate = s.LastUpdate
+	}
+
+	return nil
+}
+
+// WriteStatus writes text based status into Writer.
+func (tb *TokenBucketLimiter) WriteStatus(w io.Writer) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	fmt.Fprintf(w, "#tat %s, rate %d/%s, burst %d\n", tb.tat, tb.limit, tb.interval, tb.capacity())
+	return nil
+}